@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"nbot-wa/config"
+	"nbot-wa/util"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+const (
+	// How often the upcoming schedule is compared against the last announced one
+	scheduleChangePollInterval = 2 * time.Minute
+	scheduleChangePollTimeout  = 30 * time.Second
+)
+
+// The last schedule announced (or first seen) for a site, stored so that restarts don't miss or
+// repeat changes
+type scheduleSnapshot struct {
+	Events    []ParsedEvent
+	WindowEnd time.Time
+}
+
+// What the watcher saw on its last poll of a site, to tell when the schedule is still being edited
+type scheduleWatch struct {
+	site *config.Site
+
+	lastPolled    []ParsedEvent
+	lastPolledEnd time.Time
+	lastChangeAt  time.Time
+}
+
+type scheduleChange struct {
+	old *ParsedEvent
+	new *ParsedEvent
+}
+
+func (change *scheduleChange) event() *ParsedEvent {
+	if change.new != nil {
+		return change.new
+	}
+	return change.old
+}
+
+// Polls the schedules of the sites which announce changes
+func (state *ProgramState) RegisterChangeAnnouncements() error {
+	for _, site := range state.Config.Sites {
+		if site.ChangeAnnouncements.Days == 0 {
+			continue
+		}
+
+		_, err := state.MinyanScheduler.NewJob(
+			gocron.DurationJob(scheduleChangePollInterval),
+			gocron.NewTask(state.CheckScheduleChanges, &scheduleWatch{site: site}),
+			gocron.WithStartAt(gocron.WithStartImmediately()),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compares the site's upcoming minyanim against the last snapshot, and announces the differences
+// once the schedule has stopped changing for the debounce time
+func (state *ProgramState) CheckScheduleChanges(watch *scheduleWatch) {
+	site := watch.site
+	now := time.Now().In(site.Location)
+	windowEnd := endOfDate(now.AddDate(0, 0, site.ChangeAnnouncements.Days))
+
+	ctx, cancel := context.WithTimeout(state.Ctx, scheduleChangePollTimeout)
+	defer cancel()
+
+	current, err := state.EventSources[site.ID].Events(ctx, now, windowEnd)
+	if err != nil {
+		// Failures are reported by the sources' own syncing, and the next poll will try again
+		fmt.Println("Warning: could not check the schedule for changes:", site.ID, err)
+		return
+	}
+
+	if watch.lastPolled != nil && len(diffSchedules(watch.lastPolled, current, now, minTime(watch.lastPolledEnd, windowEnd))) != 0 {
+		watch.lastChangeAt = now
+	}
+	watch.lastPolled = current
+	watch.lastPolledEnd = windowEnd
+
+	snapshot, err := loadScheduleSnapshot(ctx, state.DB, site.ID, site.Location)
+	if err != nil {
+		state.ReportErrorToMe(err, "CheckScheduleChanges")
+		return
+	}
+
+	saveSnapshot := func() {
+		if err := saveScheduleSnapshot(ctx, state.DB, site.ID, &scheduleSnapshot{Events: current, WindowEnd: windowEnd}); err != nil {
+			state.ReportErrorToMe(err, "CheckScheduleChanges")
+		}
+	}
+
+	if snapshot == nil {
+		saveSnapshot()
+		return
+	}
+
+	changes := diffSchedules(snapshot.Events, current, now, minTime(snapshot.WindowEnd, windowEnd))
+	if len(changes) == 0 {
+		// Move the window forward
+		saveSnapshot()
+		return
+	}
+
+	// After a restart the changes may be from edits still being made, so they are waited on too
+	if watch.lastChangeAt.IsZero() {
+		watch.lastChangeAt = now
+	}
+	if now.Sub(watch.lastChangeAt) < site.ChangeAnnouncements.Debounce {
+		return
+	}
+
+	_, isYomTov, err := CurrentOrUpcomingYomTov(now, site.ZmanimLocation)
+	if err != nil {
+		state.ReportErrorToMe(err, "CurrentOrUpcomingYomTov")
+		return
+	}
+	if isYomTov {
+		// The changes stay pending until afterwards
+		return
+	}
+
+	message := formatScheduleChanges(changes, now, site, len(state.Config.Sites) > 1)
+	for _, group := range site.Groups {
+		state.QueueStringMessage(group, PriorityBroadcast, message)
+	}
+	saveSnapshot()
+}
+
+// Returns the minyanim between dtStart and dtEnd which were moved, added or cancelled. Minyanim
+// are matched by their name and date.
+func diffSchedules(old []ParsedEvent, new []ParsedEvent, dtStart time.Time, dtEnd time.Time) []scheduleChange {
+	key := func(event *ParsedEvent) string {
+		return event.DateTime.In(dtStart.Location()).Format(time.DateOnly) + "\x00" + util.NormalizeString(event.Name)
+	}
+
+	group := func(events []ParsedEvent) (map[string][]*ParsedEvent, []string) {
+		groups := map[string][]*ParsedEvent{}
+		keys := []string{}
+		for i := range events {
+			event := &events[i]
+			if event.DateTime.Before(dtStart) || event.DateTime.After(dtEnd) {
+				continue
+			}
+
+			k := key(event)
+			if groups[k] == nil {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], event)
+		}
+		return groups, keys
+	}
+
+	oldGroups, oldKeys := group(old)
+	newGroups, newKeys := group(new)
+
+	keys := oldKeys
+	for _, k := range newKeys {
+		if oldGroups[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	changes := []scheduleChange{}
+	for _, k := range keys {
+		oldEvents, newEvents := oldGroups[k], newGroups[k]
+
+		// The events are sorted, so the nth minyan with a name on a day is compared to the nth
+		for i := 0; i < max(len(oldEvents), len(newEvents)); i++ {
+			change := scheduleChange{}
+			if i < len(oldEvents) {
+				change.old = oldEvents[i]
+			}
+			if i < len(newEvents) {
+				change.new = newEvents[i]
+			}
+
+			if change.old != nil && change.new != nil &&
+				change.old.DateTime.Equal(change.new.DateTime) && change.old.AllDay == change.new.AllDay {
+				continue
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	slices.SortStableFunc(changes, func(a, b scheduleChange) int {
+		return a.event().DateTime.Compare(b.event().DateTime)
+	})
+	return changes
+}
+
+func formatScheduleChanges(changes []scheduleChange, now time.Time, site *config.Site, includeSiteName bool) string {
+	var builder strings.Builder
+	builder.WriteString("*Schedule changes")
+	if includeSiteName {
+		builder.WriteString(" at ")
+		builder.WriteString(site.Name)
+	}
+	builder.WriteString(":*")
+
+	for _, change := range changes {
+		event := change.event()
+		fmt.Fprintf(&builder, "\n• %s %s ", formatChangeDay(event.DateTime, now), strings.TrimSpace(event.Name))
+
+		switch {
+		case change.new == nil:
+			builder.WriteString("cancelled")
+		case change.old == nil:
+			builder.WriteString("added")
+			if !change.new.AllDay {
+				builder.WriteString(" at ")
+				builder.WriteString(formatMinyanTime(change.new.DateTime))
+			}
+		default:
+			fmt.Fprintf(&builder, "moved %s → %s", formatChangeTime(change.old), formatChangeTime(change.new))
+		}
+	}
+
+	return builder.String()
+}
+
+// Names days in the coming week by their weekday, and later ones by their date
+func formatChangeDay(date time.Time, now time.Time) string {
+	if startOfDate(date).Before(startOfDate(now).AddDate(0, 0, 7)) {
+		return date.Format("Monday")
+	}
+	return date.Format("Monday, Jan 2")
+}
+
+func formatChangeTime(event *ParsedEvent) string {
+	if event.AllDay {
+		return "all day"
+	}
+	return formatMinyanTime(event.DateTime)
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Returns nil if there is no snapshot for the site yet
+func loadScheduleSnapshot(ctx context.Context, db *sql.DB, siteID string, location *time.Location) (*scheduleSnapshot, error) {
+	var data string
+	err := db.QueryRowContext(ctx,
+		`SELECT data FROM schedule_snapshots WHERE site_id = ?`,
+		siteID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshot scheduleSnapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		return nil, fmt.Errorf("schedule snapshot for %s: %w", siteID, err)
+	}
+
+	for i := range snapshot.Events {
+		snapshot.Events[i].DateTime = snapshot.Events[i].DateTime.In(location)
+	}
+	snapshot.WindowEnd = snapshot.WindowEnd.In(location)
+
+	return &snapshot, nil
+}
+
+func saveScheduleSnapshot(ctx context.Context, db *sql.DB, siteID string, snapshot *scheduleSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO schedule_snapshots (site_id, data, taken_at) VALUES (?, ?, ?)`,
+		siteID, string(data), time.Now().Unix())
+	return err
+}
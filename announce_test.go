@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleChangesAreDebouncedAfterRestart(t *testing.T) {
+	source := NewMemoryEventSource()
+	state, _ := newTestProgramState(t, source)
+	site := state.Config.Sites[0]
+	site.ChangeAnnouncements.Days = 7
+	site.ChangeAnnouncements.Debounce = 10 * time.Minute
+
+	tomorrow := time.Now().In(site.Location).AddDate(0, 0, 1)
+	announced := []ParsedEvent{{Name: "Mincha", DateTime: time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 13, 45, 0, 0, site.Location)}}
+	snapshot := &scheduleSnapshot{Events: announced, WindowEnd: endOfDate(tomorrow.AddDate(0, 0, 6))}
+	if err := saveScheduleSnapshot(state.Ctx, state.DB, site.ID, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first poll after a restart, in the middle of a burst of edits
+	source.Set([]ParsedEvent{{Name: "Mincha", DateTime: announced[0].DateTime.Add(15 * time.Minute)}})
+	watch := &scheduleWatch{site: site}
+	state.CheckScheduleChanges(watch)
+
+	if pending, err := state.Outbox.Pending(state.Ctx); err != nil || len(pending) != 0 {
+		t.Errorf("Expected the change to wait for the debounce, got %v, %v", pending, err)
+	}
+	if watch.lastChangeAt.IsZero() {
+		t.Error("Expected the change to start the debounce")
+	}
+}
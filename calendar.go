@@ -2,8 +2,6 @@ package main
 
 import (
 	"errors"
-	"nbot-wa/secrets"
-	"nbot-wa/util"
 	"slices"
 	"time"
 
@@ -13,10 +11,6 @@ import (
 	"github.com/hebcal/hebcal-go/zmanim"
 )
 
-var (
-	minyanZmanimLocation = util.PanicIfNil(zmanim.LookupCity(secrets.MinyanZmanimLocation))
-)
-
 const (
 	havdalahFlags       = event.YOM_TOV_ENDS | event.LIGHT_CANDLES_TZEIS
 	candleLightingFlags = event.LIGHT_CANDLES
@@ -34,11 +28,11 @@ type CandleLightingOrHavdalah struct {
 	Time time.Time
 }
 
-func GetCandleLightingHavdalahForDateRange(start time.Time, end time.Time) ([]CandleLightingOrHavdalah, error) {
+func GetCandleLightingHavdalahForDateRange(start time.Time, end time.Time, location *zmanim.Location) ([]CandleLightingOrHavdalah, error) {
 	events, err := hebcal.HebrewCalendar(&hebcal.CalOptions{
 		Start:          hdate.FromTime(start),
 		End:            hdate.FromTime(end),
-		Location:       minyanZmanimLocation,
+		Location:       location,
 		NoHolidays:     true,
 		CandleLighting: true,
 		Mask:           event.LIGHT_CANDLES | event.YOM_TOV_ENDS,
@@ -87,11 +81,11 @@ type YomTovTimes struct {
 	Havdalah       time.Time
 }
 
-func CurrentOrUpcomingYomTov(date time.Time) (YomTovTimes, bool, error) {
+func CurrentOrUpcomingYomTov(date time.Time, location *zmanim.Location) (YomTovTimes, bool, error) {
 	startTime := date.AddDate(0, 0, -10)
 	endTime := date.AddDate(0, 0, 10)
 
-	events, err := GetCandleLightingHavdalahForDateRange(startTime, endTime)
+	events, err := GetCandleLightingHavdalahForDateRange(startTime, endTime, location)
 	if err != nil {
 		return YomTovTimes{}, false, err
 	}
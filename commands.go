@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"nbot-wa/util"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// The kinds of chat a command can be used in
+type ChatScope uint8
+
+const (
+	// Private chats with the bot
+	ChatDirect ChatScope = 1 << iota
+	// The groups of a site
+	ChatSiteGroup
+	// The maintainer's chats (me and bot_test)
+	ChatAdmin
+
+	ChatAny = ChatDirect | ChatSiteGroup | ChatAdmin
+)
+
+// Who can use a command
+type Role int
+
+const (
+	RoleAnyone Role = iota
+	// The gabbaim of any site, and the maintainer. The command still has to check that the user is
+	// a gabbai of the site it acts on.
+	RoleGabbai
+	RoleMaintainer
+)
+
+// The part of `!help` a command is listed in
+type CommandSection int
+
+const (
+	SectionMinyan CommandSection = iota
+	SectionGabbai
+	SectionMaintainer
+)
+
+var commandSectionHeadings = map[CommandSection]string{
+	SectionMinyan:     "*Usage:*",
+	SectionGabbai:     "*Gabbai commands* (for minyanim whose schedule is kept by the bot):",
+	SectionMaintainer: "*Maintainer commands:*",
+}
+
+// One way of using a command, for `!help`
+type CommandUsage struct {
+	// The arguments after the command name, e.g. "week of DATE". Several are listed as
+	// alternatives.
+	Args        []string
+	Description string
+}
+
+type Command struct {
+	// What the message starts with, e.g. "!times"
+	Name    string
+	Aliases []string
+
+	Usage []CommandUsage
+	// Explanations shown after the usage in `!help`, e.g. of the formats of the arguments
+	Notes   []string
+	Section CommandSection
+	// Commands which aren't listed in `!help`
+	Hidden bool
+
+	Chats ChatScope
+	Role  Role
+	// Whether the command is run again when the message with it is edited, with the reply edited
+	// to match. Only for commands which don't change anything, since the original was already run.
+	RerunOnEdit bool
+
+	// Called with the normalized text after the command name
+	Handle func(state *ProgramState, v *events.Message, args string)
+}
+
+// The commands the bot understands, by name and alias
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: map[string]*Command{}}
+}
+
+// Adds a command. Panics if its name or an alias is already taken, since that is a mistake in the
+// code.
+func (registry *CommandRegistry) Register(command *Command) {
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		if registry.byName[name] != nil {
+			panic(fmt.Sprintf("command %q registered twice", name))
+		}
+		registry.byName[name] = command
+	}
+	registry.commands = append(registry.commands, command)
+}
+
+// Returns the command with the given name or alias, or nil
+func (registry *CommandRegistry) Lookup(name string) *Command {
+	return registry.byName[name]
+}
+
+// Registers the bot's commands, in the order `!help` lists them
+func (state *ProgramState) RegisterCommands() {
+	state.Commands = NewCommandRegistry()
+	state.registerMinyanCommands()
+	state.registerScheduleCommands()
+	state.registerDebugCommands()
+}
+
+// Runs the command that v starts with, if it is allowed in the chat and for the sender
+func (state *ProgramState) HandleCommand(v *events.Message) {
+	if state.Commands == nil {
+		return
+	}
+
+	text, mentioned := state.stripBotMention(v.Message, MessageText(v.Message))
+	text = util.NormalizeString(text)
+	name, args, _ := strings.Cut(text, " ")
+	// When the bot is mentioned it is clear that the message is for it, so the ! is optional
+	if mentioned && !strings.HasPrefix(name, "!") {
+		name = "!" + name
+	}
+
+	scopes := state.chatScopes(v.Info.Chat, v.Info.IsGroup)
+	if scopes == 0 {
+		// Groups the bot is in for other reasons
+		return
+	}
+
+	command := state.Commands.Lookup(name)
+	if command == nil && mentioned {
+		// Questions like "@Bot when is mincha tomorrow" are answered with `!times`
+		if timesArgs, ok := state.timesQuestionArgs(v.Info.Chat, text); ok {
+			command, args = state.Commands.Lookup("!times"), timesArgs
+		}
+	}
+	if command == nil || command.Chats&scopes == 0 {
+		if mentioned {
+			state.QueueReply(v, state.unknownCommandMessage(name, scopes))
+		}
+		return
+	}
+
+	if v.IsEdit && !command.RerunOnEdit {
+		return
+	}
+
+	if !state.hasRole(v, command.Role) {
+		switch command.Role {
+		case RoleGabbai:
+			state.QueueReply(v, fmt.Sprintf("```Only the gabbaim can use %s```", command.Name))
+		default:
+			state.QueueReply(v, fmt.Sprintf("```Only %s can use %s```", state.Config.MaintainerName, command.Name))
+		}
+		return
+	}
+
+	command.Handle(state, v, args)
+}
+
+// The reply to a message for the bot which doesn't start with a command, suggesting the command the
+// user most likely meant
+func (state *ProgramState) unknownCommandMessage(name string, scopes ChatScope) string {
+	names := []string{}
+	for _, command := range state.Commands.commands {
+		if !command.Hidden && command.Chats&scopes != 0 {
+			names = append(names, command.Name)
+			names = append(names, command.Aliases...)
+		}
+	}
+
+	if suggestion := closestWord(name, names); suggestion != "" {
+		return fmt.Sprintf("I don't know `%s` — did you mean `%s`? Send `!help` for the commands I know", name, suggestion)
+	}
+	return "I didn't understand that. Send `!help` for the commands I know"
+}
+
+// Removes the mentions of the bot (like "@18001231234") from text, the text of message. Returns
+// whether there were any.
+func (state *ProgramState) stripBotMention(message *waE2E.Message, text string) (string, bool) {
+	mentioned := false
+	for _, mention := range messageContextInfo(message).GetMentionedJID() {
+		jid, err := types.ParseJID(mention)
+		if err != nil {
+			continue
+		}
+		for _, bot := range state.botJIDs() {
+			if jid.User == bot.User && jid.Server == bot.Server {
+				text = strings.ReplaceAll(text, "@"+jid.User, " ")
+				mentioned = true
+			}
+		}
+	}
+	return text, mentioned
+}
+
+// The bot's phone number and LID, to recognize mentions. The LID is read each time, since it is
+// only known once the bot has paired, which may be after events start being handled.
+func (state *ProgramState) botJIDs() []types.JID {
+	jids := []types.JID{types.NewJID(state.Config.BotPhoneNumber, types.DefaultUserServer)}
+	if state.DeviceStore != nil && !state.DeviceStore.LID.IsEmpty() {
+		jids = append(jids, state.DeviceStore.LID.ToNonAD())
+	}
+	return jids
+}
+
+func (state *ProgramState) chatScopes(chat types.JID, isGroup bool) ChatScope {
+	var scopes ChatScope
+	if !isGroup {
+		scopes |= ChatDirect
+	}
+	if state.Config.SiteForChat(chat) != nil {
+		scopes |= ChatSiteGroup
+	}
+	if chat == state.Config.ChatIDMe || chat == state.Config.ChatIDBotTest {
+		scopes |= ChatAdmin
+	}
+	return scopes
+}
+
+// Whether v was sent by the maintainer (from any of their devices)
+func (state *ProgramState) isMaintainer(v *events.Message) bool {
+	return v.Info.Sender.User == state.Config.ChatIDMe.User || v.Info.SenderAlt.User == state.Config.ChatIDMe.User
+}
+
+func (state *ProgramState) hasRole(v *events.Message, role Role) bool {
+	switch role {
+	case RoleGabbai:
+		if state.isMaintainer(v) {
+			return true
+		}
+		for _, site := range state.Config.Sites {
+			if site.IsGabbai(v.Info.Sender, v.Info.SenderAlt) {
+				return true
+			}
+		}
+		return false
+	case RoleMaintainer:
+		return state.isMaintainer(v)
+	default:
+		return true
+	}
+}
+
+// Lists the commands which can be used in the chat, from the registry
+func (state *ProgramState) helpMessage(chat types.JID, isGroup bool) string {
+	scopes := state.chatScopes(chat, isGroup)
+
+	var builder strings.Builder
+	for _, section := range []CommandSection{SectionMinyan, SectionGabbai, SectionMaintainer} {
+		headingWritten := false
+		for _, command := range state.Commands.commands {
+			if command.Section != section || command.Hidden || command.Chats&scopes == 0 {
+				continue
+			}
+
+			if !headingWritten {
+				if builder.Len() > 0 {
+					builder.WriteString("\n\n")
+				}
+				builder.WriteString(commandSectionHeadings[section])
+				headingWritten = true
+			}
+			writeCommandHelp(&builder, command)
+		}
+	}
+
+	return builder.String()
+}
+
+func writeCommandHelp(builder *strings.Builder, command *Command) {
+	for _, usage := range command.Usage {
+		forms := []string{}
+		for _, args := range usage.Args {
+			forms = append(forms, "`"+strings.TrimSpace(command.Name+" "+args)+"`")
+		}
+
+		builder.WriteString("\n\n")
+		builder.WriteString(strings.Join(forms, " or "))
+		builder.WriteString("\n- ")
+		builder.WriteString(usage.Description)
+	}
+
+	if len(command.Aliases) > 0 {
+		fmt.Fprintf(builder, "\n\n`%s` can also be written `%s`", command.Name, strings.Join(command.Aliases, "`, `"))
+	}
+
+	for _, note := range command.Notes {
+		builder.WriteString("\n\n")
+		builder.WriteString(note)
+	}
+}
@@ -0,0 +1,710 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nbot-wa/util"
+
+	"github.com/hebcal/hebcal-go/zmanim"
+	"go.mau.fi/whatsmeow/types"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPath         = "secrets/config.yaml"
+	DefaultDatabasePath = "secrets/nbot.db"
+
+	// How long the bot waits on shutdown for running jobs and queued messages, by default
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// Environment variable that overrides the path of the config file
+	PathEnvVar = "NBOT_CONFIG"
+)
+
+var (
+	rSiteID   = regexp.MustCompile(`^[a-z0-9_]+$`)
+	rPostTime = regexp.MustCompile(`^(\d{1,2}):(\d{2})$`)
+)
+
+// The config file as it is written on disk. Every field can be overridden by the environment
+// variable listed in envOverrides (or siteEnvOverrides for the fields of a site).
+type fileConfig struct {
+	MaintainerName string `yaml:"maintainer_name"`
+	BotPhoneNumber string `yaml:"bot_phone_number"`
+	Timezone       string `yaml:"timezone"`
+	Database       string `yaml:"database"`
+
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
+
+	Chats struct {
+		Me      string `yaml:"me"`
+		BotTest string `yaml:"bot_test"`
+	} `yaml:"chats"`
+
+	GoogleCalendar struct {
+		APIKey string `yaml:"api_key"`
+	} `yaml:"google_calendar"`
+
+	Sending fileSending `yaml:"sending"`
+
+	Sites []fileSite `yaml:"sites"`
+}
+
+type fileSite struct {
+	ID       string   `yaml:"id"`
+	Name     string   `yaml:"name"`
+	Aliases  []string `yaml:"aliases"`
+	Calendar struct {
+		Type     string `yaml:"type"`
+		ID       string `yaml:"id"`
+		URL      string `yaml:"url"`
+		Auth     string `yaml:"auth"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"calendar"`
+	Timezone   string   `yaml:"timezone"`
+	ZmanimCity string   `yaml:"zmanim_city"`
+	Groups     []string `yaml:"groups"`
+	Gabbaim    []string `yaml:"gabbaim"`
+
+	ScheduledPosts []struct {
+		At    string `yaml:"at"`
+		Times string `yaml:"times"`
+	} `yaml:"scheduled_posts"`
+
+	ChangeAnnouncements struct {
+		Days     int    `yaml:"days"`
+		Debounce string `yaml:"debounce"`
+	} `yaml:"change_announcements"`
+
+	PinnedWeek *struct {
+		At string `yaml:"at"`
+	} `yaml:"pinned_week"`
+
+	ZmanimRules []struct {
+		Name  string `yaml:"name"`
+		Time  string `yaml:"time"`
+		Days  string `yaml:"days"`
+		From  string `yaml:"from"`
+		Until string `yaml:"until"`
+	} `yaml:"zmanim_rules"`
+}
+
+var envOverrides = []struct {
+	name  string
+	field func(*fileConfig) *string
+}{
+	{"NBOT_MAINTAINER_NAME", func(c *fileConfig) *string { return &c.MaintainerName }},
+	{"NBOT_BOT_PHONE_NUMBER", func(c *fileConfig) *string { return &c.BotPhoneNumber }},
+	{"NBOT_TIMEZONE", func(c *fileConfig) *string { return &c.Timezone }},
+	{"NBOT_DATABASE", func(c *fileConfig) *string { return &c.Database }},
+	{"NBOT_SHUTDOWN_TIMEOUT", func(c *fileConfig) *string { return &c.ShutdownTimeout }},
+	{"NBOT_CHAT_ME", func(c *fileConfig) *string { return &c.Chats.Me }},
+	{"NBOT_CHAT_BOT_TEST", func(c *fileConfig) *string { return &c.Chats.BotTest }},
+	{"NBOT_GOOGLE_CALENDAR_API_KEY", func(c *fileConfig) *string { return &c.GoogleCalendar.APIKey }},
+}
+
+// Site overrides are named NBOT_SITE_<ID>_<SUFFIX>, e.g. NBOT_SITE_BEIS_MIDRASH_CALENDAR_ID
+var siteEnvOverrides = []struct {
+	suffix string
+	field  func(*fileSite) *string
+}{
+	{"NAME", func(s *fileSite) *string { return &s.Name }},
+	{"CALENDAR_TYPE", func(s *fileSite) *string { return &s.Calendar.Type }},
+	{"CALENDAR_ID", func(s *fileSite) *string { return &s.Calendar.ID }},
+	{"CALENDAR_URL", func(s *fileSite) *string { return &s.Calendar.URL }},
+	{"CALENDAR_AUTH", func(s *fileSite) *string { return &s.Calendar.Auth }},
+	{"CALENDAR_USERNAME", func(s *fileSite) *string { return &s.Calendar.Username }},
+	{"CALENDAR_PASSWORD", func(s *fileSite) *string { return &s.Calendar.Password }},
+	{"TIMEZONE", func(s *fileSite) *string { return &s.Timezone }},
+	{"ZMANIM_CITY", func(s *fileSite) *string { return &s.ZmanimCity }},
+}
+
+// Comma-separated list of group JIDs
+const siteGroupsEnvSuffix = "GROUPS"
+
+// The validated runtime configuration
+type Config struct {
+	MaintainerName string
+	BotPhoneNumber string
+
+	// Timezone for jobs that aren't tied to a site, like the maintainer's reminders
+	Location *time.Location
+
+	// Path of the bot's own SQLite database
+	DatabasePath string
+
+	// On shutdown, how long to wait for running jobs to finish and queued messages to be sent.
+	// Messages which aren't sent by then are sent after the next start.
+	ShutdownTimeout time.Duration
+
+	ChatIDMe      types.JID
+	ChatIDBotTest types.JID
+
+	GoogleCalendarAPIKey string
+
+	Sending Sending
+
+	Sites []*Site
+}
+
+// A single congregation served by the bot
+type Site struct {
+	ID      string
+	Name    string
+	Aliases []string
+
+	Calendar Calendar
+
+	Location       *time.Location
+	ZmanimLocation *zmanim.Location
+
+	// The groups whose `!times` requests default to this site, and which receive its scheduled posts
+	Groups []types.JID
+
+	// Users allowed to manage the site's schedule from chat (along with the maintainer)
+	Gabbaim []types.JID
+
+	ScheduledPosts []ScheduledPost
+
+	ChangeAnnouncements ChangeAnnouncements
+
+	// Nil if the groups don't have a pinned message with the week's schedule
+	PinnedWeek *PinnedWeek
+
+	// Minyanim at times relative to the zmanim, shown alongside the calendar's events
+	ZmanimRules []ZmanimRule
+}
+
+const (
+	CalendarTypeGoogle = "google"
+	CalendarTypeICal   = "ical"
+	CalendarTypeCalDAV = "caldav"
+	CalendarTypeLocal  = "local"
+	CalendarTypeNone   = "none"
+
+	CalendarAuthBasic  = "basic"
+	CalendarAuthDigest = "digest"
+)
+
+// Where a site's minyan times come from, other than its zmanim rules
+type Calendar struct {
+	Type string
+
+	// The calendar ID, for Google calendars
+	ID string
+
+	// The URL or file path for iCalendar files, or the calendar collection URL for CalDAV
+	URL string
+
+	// The login for CalDAV servers: CalendarAuthBasic, CalendarAuthDigest or empty for none
+	Auth     string
+	Username string
+	Password string
+}
+
+type ScheduledPost struct {
+	Hour   uint
+	Minute uint
+
+	// The argument to `!times` which produces the post, e.g. "upcoming" or "week"
+	Times string
+}
+
+// DefaultAnnouncementDebounce is how long to wait after the last change to a site's schedule before
+// announcing the changes, if the config doesn't say
+const DefaultAnnouncementDebounce = 10 * time.Minute
+
+// Posting to a site's groups when its upcoming minyanim change
+type ChangeAnnouncements struct {
+	// How many days ahead to watch, or 0 if changes aren't announced
+	Days int
+
+	// How long to wait after the last change before posting, so that a burst of edits produces
+	// a single message
+	Debounce time.Duration
+}
+
+// A message with the week's schedule, pinned in a site's groups and kept up to date
+type PinnedWeek struct {
+	// When it is posted on Sunday
+	Hour   uint
+	Minute uint
+}
+
+// A minyan whose time is computed from the zmanim each day
+type ZmanimRule struct {
+	Name string
+
+	// An expression like "shkiah - 15m, rounded down to 5 min"
+	Time string
+
+	// The days of the week the minyan is on, like "sun-thu" (empty for every day)
+	Days string
+
+	// The first and last dates (inclusive) the rule applies to, as YYYY-MM-DD, or empty for no limit
+	From  string
+	Until string
+}
+
+func (c *Config) ChatIDsToRead() []types.JID {
+	chats := []types.JID{
+		c.ChatIDBotTest,
+		c.ChatIDMe,
+	}
+	for _, site := range c.Sites {
+		chats = append(chats, site.Groups...)
+	}
+	return chats
+}
+
+// Returns the site whose groups include chat, or nil if there isn't one
+func (c *Config) SiteForChat(chat types.JID) *Site {
+	for _, site := range c.Sites {
+		for _, group := range site.Groups {
+			if group == chat {
+				return site
+			}
+		}
+	}
+	return nil
+}
+
+// If text starts with the ID, name or an alias of a site, returns that site along with the rest
+// of the text. Otherwise returns nil and text unchanged. text should already be normalized with
+// util.NormalizeString.
+func (c *Config) CutSitePrefix(text string) (*Site, string) {
+	var bestSite *Site
+	bestRest := text
+	bestLength := 0
+
+	for _, site := range c.Sites {
+		for _, name := range site.names() {
+			rest, found := strings.CutPrefix(text, name)
+			if !found || len(name) <= bestLength {
+				continue
+			}
+			if rest != "" && rest[0] != ' ' {
+				// Only match whole words
+				continue
+			}
+
+			bestSite = site
+			bestRest = strings.TrimSpace(rest)
+			bestLength = len(name)
+		}
+	}
+
+	return bestSite, bestRest
+}
+
+// Returns whether any of users (e.g. a message's Sender and SenderAlt) is one of the site's gabbaim
+func (s *Site) IsGabbai(users ...types.JID) bool {
+	for _, user := range users {
+		if user.IsEmpty() {
+			continue
+		}
+		for _, gabbai := range s.Gabbaim {
+			if gabbai.User == user.User && gabbai.Server == user.Server {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// All the normalized names that can be used to refer to the site
+func (s *Site) names() []string {
+	names := []string{
+		util.NormalizeString(s.ID),
+		util.NormalizeString(strings.ReplaceAll(s.ID, "_", " ")),
+		util.NormalizeString(s.Name),
+	}
+	for _, alias := range s.Aliases {
+		names = append(names, util.NormalizeString(alias))
+	}
+	return names
+}
+
+// Returns the config file path, taking the environment override into account
+func Path() string {
+	if path, ok := os.LookupEnv(PathEnvVar); ok && path != "" {
+		return path
+	}
+	return DefaultPath
+}
+
+// Checks of site values whose parsers are outside this package, since they are shared with the
+// bot's commands. Their errors are reported along with the other validation problems. Nil checks
+// are skipped.
+type Checks struct {
+	// Checks a zmanim rule's time expression and days
+	ZmanimRule func(rule ZmanimRule, location *time.Location) error
+	// Checks the `!times` arguments of a scheduled post
+	Times func(times string, site *Site) error
+}
+
+// Reads the config file at path, applies environment overrides and validates the result. All
+// validation problems are reported together in the returned error.
+func Load(path string, checks Checks) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var raw fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	raw.applyEnvOverrides()
+
+	cfg, err := raw.validate(checks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", path, err)
+	}
+	return cfg, nil
+}
+
+func (raw *fileConfig) applyEnvOverrides() {
+	for _, override := range envOverrides {
+		if value, ok := os.LookupEnv(override.name); ok {
+			*override.field(raw) = value
+		}
+	}
+
+	for i := range raw.Sites {
+		site := &raw.Sites[i]
+		prefix := "NBOT_SITE_" + strings.ToUpper(site.ID) + "_"
+
+		for _, override := range siteEnvOverrides {
+			if value, ok := os.LookupEnv(prefix + override.suffix); ok {
+				*override.field(site) = value
+			}
+		}
+
+		if value, ok := os.LookupEnv(prefix + siteGroupsEnvSuffix); ok {
+			site.Groups = util.Filter(strings.Split(value, ","), func(s string) bool { return s != "" })
+			for j := range site.Groups {
+				site.Groups[j] = strings.TrimSpace(site.Groups[j])
+			}
+		}
+	}
+}
+
+func (raw *fileConfig) validate(checks Checks) (*Config, error) {
+	var errs []error
+	cfg := &Config{
+		MaintainerName:       raw.MaintainerName,
+		BotPhoneNumber:       raw.BotPhoneNumber,
+		DatabasePath:         raw.Database,
+		GoogleCalendarAPIKey: raw.GoogleCalendar.APIKey,
+	}
+
+	if cfg.DatabasePath == "" {
+		cfg.DatabasePath = DefaultDatabasePath
+	}
+
+	cfg.ShutdownTimeout = DefaultShutdownTimeout
+	if raw.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(raw.ShutdownTimeout)
+		if err != nil || timeout < 0 {
+			errs = append(errs, fmt.Errorf("shutdown_timeout: invalid duration %q (expected e.g. \"30s\")", raw.ShutdownTimeout))
+		} else {
+			cfg.ShutdownTimeout = timeout
+		}
+	}
+
+	sending, sendingErrs := raw.Sending.validate()
+	cfg.Sending = sending
+	errs = append(errs, sendingErrs...)
+
+	require := func(key string, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%s: required", key))
+		}
+	}
+	require("maintainer_name", raw.MaintainerName)
+	require("bot_phone_number", raw.BotPhoneNumber)
+
+	parseChat := func(key string, value string, dest *types.JID) {
+		jid, err := ParseChatJID(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			return
+		}
+		*dest = jid
+	}
+	parseChat("chats.me", raw.Chats.Me, &cfg.ChatIDMe)
+	parseChat("chats.bot_test", raw.Chats.BotTest, &cfg.ChatIDBotTest)
+
+	if location, err := LoadTimezone(raw.Timezone); err != nil {
+		errs = append(errs, fmt.Errorf("timezone: %w", err))
+	} else {
+		cfg.Location = location
+	}
+
+	if len(raw.Sites) == 0 {
+		errs = append(errs, errors.New("sites: at least one site is required"))
+	}
+
+	seenIDs := map[string]bool{}
+	seenGroups := map[types.JID]string{}
+	for i, rawSite := range raw.Sites {
+		key := fmt.Sprintf("sites[%d]", i)
+		if rawSite.ID != "" {
+			key = fmt.Sprintf("sites[%s]", rawSite.ID)
+		}
+
+		site := &Site{
+			ID:      rawSite.ID,
+			Name:    rawSite.Name,
+			Aliases: rawSite.Aliases,
+			Calendar: Calendar{
+				Type:     rawSite.Calendar.Type,
+				ID:       rawSite.Calendar.ID,
+				URL:      rawSite.Calendar.URL,
+				Auth:     rawSite.Calendar.Auth,
+				Username: rawSite.Calendar.Username,
+				Password: rawSite.Calendar.Password,
+			},
+		}
+
+		if !rSiteID.MatchString(rawSite.ID) {
+			errs = append(errs, fmt.Errorf("%s.id: must be non-empty and contain only a-z, 0-9 and _, got %q", key, rawSite.ID))
+		} else if seenIDs[rawSite.ID] {
+			errs = append(errs, fmt.Errorf("%s.id: duplicate site ID", key))
+		}
+		seenIDs[rawSite.ID] = true
+
+		if site.Name == "" {
+			site.Name = rawSite.ID
+		}
+
+		if site.Calendar.Type == "" {
+			site.Calendar.Type = CalendarTypeGoogle
+		}
+		switch site.Calendar.Type {
+		case CalendarTypeGoogle:
+			require(key+".calendar.id", site.Calendar.ID)
+		case CalendarTypeICal:
+			require(key+".calendar.url", site.Calendar.URL)
+		case CalendarTypeLocal, CalendarTypeNone:
+		case CalendarTypeCalDAV:
+			require(key+".calendar.url", site.Calendar.URL)
+			switch site.Calendar.Auth {
+			case "":
+			case CalendarAuthBasic, CalendarAuthDigest:
+				require(key+".calendar.username", site.Calendar.Username)
+			default:
+				errs = append(errs, fmt.Errorf("%s.calendar.auth: unknown method %q (expected %q or %q)",
+					key, site.Calendar.Auth, CalendarAuthBasic, CalendarAuthDigest))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.calendar.type: unknown type %q (expected %q, %q, %q, %q or %q)",
+				key, site.Calendar.Type, CalendarTypeGoogle, CalendarTypeICal, CalendarTypeCalDAV, CalendarTypeLocal, CalendarTypeNone))
+		}
+
+		if location, err := LoadTimezone(rawSite.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("%s.timezone: %w", key, err))
+		} else {
+			site.Location = location
+		}
+
+		if city, err := LookupZmanimCity(rawSite.ZmanimCity); err != nil {
+			errs = append(errs, fmt.Errorf("%s.zmanim_city: %w", key, err))
+		} else {
+			site.ZmanimLocation = city
+		}
+
+		for j, group := range rawSite.Groups {
+			groupKey := fmt.Sprintf("%s.groups[%d]", key, j)
+			jid, err := ParseChatJID(group)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", groupKey, err))
+				continue
+			}
+			if other, ok := seenGroups[jid]; ok {
+				errs = append(errs, fmt.Errorf("%s: group is already assigned to site %q", groupKey, other))
+				continue
+			}
+			seenGroups[jid] = rawSite.ID
+			site.Groups = append(site.Groups, jid)
+		}
+
+		for j, gabbai := range rawSite.Gabbaim {
+			jid, err := ParseChatJID(gabbai)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.gabbaim[%d]: %w", key, j, err))
+				continue
+			}
+			site.Gabbaim = append(site.Gabbaim, jid)
+		}
+
+		for j, rawPost := range rawSite.ScheduledPosts {
+			postKey := fmt.Sprintf("%s.scheduled_posts[%d]", key, j)
+			hour, minute, err := parsePostTime(rawPost.At)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.at: %w", postKey, err))
+				continue
+			}
+
+			times := rawPost.Times
+			if times == "" {
+				times = "upcoming"
+			}
+			if checks.Times != nil && site.Location != nil {
+				if err := checks.Times(times, site); err != nil {
+					errs = append(errs, fmt.Errorf("%s.times: %w", postKey, err))
+				}
+			}
+
+			site.ScheduledPosts = append(site.ScheduledPosts, ScheduledPost{
+				Hour:   hour,
+				Minute: minute,
+				Times:  times,
+			})
+		}
+
+		site.ChangeAnnouncements.Days = rawSite.ChangeAnnouncements.Days
+		site.ChangeAnnouncements.Debounce = DefaultAnnouncementDebounce
+		if rawSite.ChangeAnnouncements.Days < 0 {
+			errs = append(errs, fmt.Errorf("%s.change_announcements.days: must not be negative", key))
+		}
+		if rawDebounce := rawSite.ChangeAnnouncements.Debounce; rawDebounce != "" {
+			debounce, err := time.ParseDuration(rawDebounce)
+			if err != nil || debounce < 0 {
+				errs = append(errs, fmt.Errorf("%s.change_announcements.debounce: invalid duration %q (expected e.g. \"10m\")", key, rawDebounce))
+			} else {
+				site.ChangeAnnouncements.Debounce = debounce
+			}
+		}
+
+		if rawSite.PinnedWeek != nil {
+			hour, minute, err := parsePostTime(rawSite.PinnedWeek.At)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.pinned_week.at: %w", key, err))
+			} else {
+				site.PinnedWeek = &PinnedWeek{Hour: hour, Minute: minute}
+			}
+		}
+
+		for j, rawRule := range rawSite.ZmanimRules {
+			ruleKey := fmt.Sprintf("%s.zmanim_rules[%d]", key, j)
+			require(ruleKey+".name", rawRule.Name)
+			require(ruleKey+".time", rawRule.Time)
+
+			for _, date := range []struct{ field, value string }{{"from", rawRule.From}, {"until", rawRule.Until}} {
+				if _, err := time.Parse(time.DateOnly, date.value); date.value != "" && err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s: expected a date like 2025-03-30, got %q", ruleKey, date.field, date.value))
+				}
+			}
+			if rawRule.From != "" && rawRule.Until != "" && rawRule.Until < rawRule.From {
+				errs = append(errs, fmt.Errorf("%s: until is before from", ruleKey))
+			}
+
+			rule := ZmanimRule{
+				Name:  rawRule.Name,
+				Time:  rawRule.Time,
+				Days:  rawRule.Days,
+				From:  rawRule.From,
+				Until: rawRule.Until,
+			}
+			if checks.ZmanimRule != nil && rule.Time != "" && site.Location != nil {
+				if err := checks.ZmanimRule(rule, site.Location); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", ruleKey, err))
+				}
+			}
+			site.ZmanimRules = append(site.ZmanimRules, rule)
+		}
+
+		cfg.Sites = append(cfg.Sites, site)
+	}
+
+	usesGoogle := slices.ContainsFunc(cfg.Sites, func(site *Site) bool {
+		return site.Calendar.Type == CalendarTypeGoogle
+	})
+	if usesGoogle {
+		require("google_calendar.api_key", raw.GoogleCalendar.APIKey)
+	}
+
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// Parses a 24-hour "HH:MM" time
+func parsePostTime(value string) (uint, uint, error) {
+	match := rPostTime.FindStringSubmatch(value)
+	if match == nil {
+		return 0, 0, fmt.Errorf("invalid time %q (expected 24-hour HH:MM, e.g. \"20:30\")", value)
+	}
+
+	hour, _ := strconv.Atoi(match[1])
+	minute, _ := strconv.Atoi(match[2])
+	if hour > 23 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid time %q (expected 24-hour HH:MM, e.g. \"20:30\")", value)
+	}
+
+	return uint(hour), uint(minute), nil
+}
+
+// Parses a user (…@s.whatsapp.net, …@lid) or group (…@g.us) JID
+func ParseChatJID(value string) (types.JID, error) {
+	if value == "" {
+		return types.JID{}, errors.New("required")
+	}
+
+	jid, err := types.ParseJID(value)
+	if err != nil {
+		return types.JID{}, fmt.Errorf("invalid JID %q: %w", value, err)
+	}
+
+	switch jid.Server {
+	case types.DefaultUserServer, types.HiddenUserServer, types.GroupServer:
+	default:
+		return types.JID{}, fmt.Errorf("invalid JID %q: expected a user (@%s) or group (@%s) JID",
+			value, types.DefaultUserServer, types.GroupServer)
+	}
+
+	if jid.User == "" {
+		return types.JID{}, fmt.Errorf("invalid JID %q: missing the part before the '@'", value)
+	}
+
+	return jid, nil
+}
+
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, errors.New("required")
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q (expected an IANA name like \"America/New_York\")", name)
+	}
+	return location, nil
+}
+
+func LookupZmanimCity(name string) (*zmanim.Location, error) {
+	if name == "" {
+		return nil, errors.New("required")
+	}
+
+	city := zmanim.LookupCity(name)
+	if city == nil {
+		return nil, fmt.Errorf("unknown city %q (see zmanim.AllCities() for the supported names)", name)
+	}
+	return city, nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// The sending section of the config file
+type fileSending struct {
+	MaxMessageLength int `yaml:"max_message_length"`
+	MaxMessageParts  int `yaml:"max_message_parts"`
+
+	RateLimit struct {
+		MessagesPerMinute float64 `yaml:"messages_per_minute"`
+		Burst             int     `yaml:"burst"`
+	} `yaml:"rate_limit"`
+
+	Direct fileChatPacing `yaml:"direct"`
+	Group  fileChatPacing `yaml:"group"`
+	Admin  fileChatPacing `yaml:"admin"`
+}
+
+type fileChatPacing struct {
+	Delay   string `yaml:"delay"`
+	Typing  string `yaml:"typing"`
+	Spacing string `yaml:"spacing"`
+}
+
+// How the bot paces the messages it sends
+type Sending struct {
+	// Longer messages are split into parts of at most MaxMessageLength characters, and cut short
+	// after MaxMessageParts parts
+	MaxMessageLength int
+	MaxMessageParts  int
+
+	// The limit across all chats, as a token bucket
+	MessagesPerMinute float64
+	Burst             int
+
+	// Pacing for private chats, groups, and the maintainer's chats (me and bot_test)
+	Direct ChatPacing
+	Group  ChatPacing
+	Admin  ChatPacing
+}
+
+// Delays that make the bot look less like a bot in one kind of chat
+type ChatPacing struct {
+	// Before starting to type
+	Delay DurationRange
+	// Showing "typing..." before the message is sent
+	Typing DurationRange
+	// The minimum time between two messages in the same chat
+	Spacing DurationRange
+}
+
+// A random duration between Min and Max
+type DurationRange struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (r DurationRange) Random() time.Duration {
+	if r.Max <= r.Min {
+		return r.Min
+	}
+	return r.Min + rand.N(r.Max-r.Min)
+}
+
+var defaultSending = Sending{
+	MaxMessageLength:  4000,
+	MaxMessageParts:   4,
+	MessagesPerMinute: 20,
+	Burst:             5,
+	Direct: ChatPacing{
+		Delay:   DurationRange{500 * time.Millisecond, 1 * time.Second},
+		Typing:  DurationRange{1 * time.Second, 2 * time.Second},
+		Spacing: DurationRange{4 * time.Second, 5 * time.Second},
+	},
+	Group: ChatPacing{
+		Delay:   DurationRange{500 * time.Millisecond, 1 * time.Second},
+		Typing:  DurationRange{1 * time.Second, 2 * time.Second},
+		Spacing: DurationRange{4 * time.Second, 5 * time.Second},
+	},
+	Admin: ChatPacing{
+		Spacing: DurationRange{1 * time.Second, 1 * time.Second},
+	},
+}
+
+func (raw *fileSending) validate() (Sending, []error) {
+	var errs []error
+	sending := defaultSending
+
+	// Leave room for the part markers
+	if raw.MaxMessageLength < 0 || (raw.MaxMessageLength > 0 && raw.MaxMessageLength < 200) {
+		errs = append(errs, fmt.Errorf("sending.max_message_length: must be at least 200"))
+	} else if raw.MaxMessageLength != 0 {
+		sending.MaxMessageLength = raw.MaxMessageLength
+	}
+
+	if raw.MaxMessageParts < 0 {
+		errs = append(errs, fmt.Errorf("sending.max_message_parts: must not be negative"))
+	} else if raw.MaxMessageParts != 0 {
+		sending.MaxMessageParts = raw.MaxMessageParts
+	}
+
+	if raw.RateLimit.MessagesPerMinute < 0 {
+		errs = append(errs, fmt.Errorf("sending.rate_limit.messages_per_minute: must not be negative"))
+	} else if raw.RateLimit.MessagesPerMinute != 0 {
+		sending.MessagesPerMinute = raw.RateLimit.MessagesPerMinute
+	}
+
+	if raw.RateLimit.Burst < 0 {
+		errs = append(errs, fmt.Errorf("sending.rate_limit.burst: must not be negative"))
+	} else if raw.RateLimit.Burst != 0 {
+		sending.Burst = raw.RateLimit.Burst
+	}
+
+	for _, chatType := range []struct {
+		key  string
+		raw  *fileChatPacing
+		dest *ChatPacing
+	}{
+		{"direct", &raw.Direct, &sending.Direct},
+		{"group", &raw.Group, &sending.Group},
+		{"admin", &raw.Admin, &sending.Admin},
+	} {
+		for _, field := range []struct {
+			key  string
+			raw  string
+			dest *DurationRange
+		}{
+			{"delay", chatType.raw.Delay, &chatType.dest.Delay},
+			{"typing", chatType.raw.Typing, &chatType.dest.Typing},
+			{"spacing", chatType.raw.Spacing, &chatType.dest.Spacing},
+		} {
+			if field.raw == "" {
+				continue
+			}
+
+			r, err := ParseDurationRange(field.raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("sending.%s.%s: %w", chatType.key, field.key, err))
+				continue
+			}
+			*field.dest = r
+		}
+	}
+
+	return sending, errs
+}
+
+// Parses a duration like "2s", or a range like "500ms-1s"
+func ParseDurationRange(value string) (DurationRange, error) {
+	minValue, maxValue, isRange := strings.Cut(value, "-")
+	if !isRange {
+		maxValue = minValue
+	}
+
+	minDuration, minErr := time.ParseDuration(strings.TrimSpace(minValue))
+	maxDuration, maxErr := time.ParseDuration(strings.TrimSpace(maxValue))
+	if minErr != nil || maxErr != nil || minDuration < 0 || maxDuration < minDuration {
+		return DurationRange{}, fmt.Errorf("invalid duration or range %q (expected e.g. \"2s\" or \"500ms-1s\")", value)
+	}
+
+	return DurationRange{minDuration, maxDuration}, nil
+}
@@ -1,13 +1,99 @@
 package main
 
 import (
-	"nbot-wa/util"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"go.mau.fi/whatsmeow/types/events"
 )
 
-func (state *ProgramState) HandleDebugMessage(v *events.Message) {
-	if util.NormalizeString(v.Message.GetConversation()) == "ping" {
-		state.QueueSimpleStringMessage(v.Info.Chat, "pong")
+func (state *ProgramState) registerDebugCommands() {
+	state.Commands.Register(&Command{
+		Name:        "ping",
+		Hidden:      true,
+		Chats:       ChatAdmin,
+		Role:        RoleAnyone,
+		RerunOnEdit: true,
+		Handle: func(state *ProgramState, v *events.Message, args string) {
+			// Only the word by itself, not a message which starts with it
+			if args != "" {
+				return
+			}
+			state.QueueReply(v, "pong")
+		},
+	})
+
+	state.Commands.Register(&Command{
+		Name:        "!calendars",
+		Usage:       []CommandUsage{{[]string{""}, "Shows when each Google calendar was last synced"}},
+		Section:     SectionMaintainer,
+		Chats:       ChatAdmin,
+		Role:        RoleMaintainer,
+		RerunOnEdit: true,
+		Handle: func(state *ProgramState, v *events.Message, args string) {
+			state.QueueReply(v, state.calendarStatusMessage())
+		},
+	})
+
+	state.Commands.Register(&Command{
+		Name:    "!sync",
+		Usage:   []CommandUsage{{[]string{""}, "Syncs the Google calendars now"}},
+		Section: SectionMaintainer,
+		Chats:   ChatAdmin,
+		Role:    RoleMaintainer,
+		Handle: func(state *ProgramState, v *events.Message, args string) {
+			for _, cache := range state.GoogleCalendars {
+				// Errors are shown in the status
+				cache.Sync(state.Ctx)
+			}
+			state.QueueReply(v, state.calendarStatusMessage())
+		},
+	})
+
+	state.Commands.Register(&Command{
+		Name:        "!delivery",
+		Usage:       []CommandUsage{{[]string{""}, "Shows whether recent broadcasts were delivered and read"}},
+		Section:     SectionMaintainer,
+		Chats:       ChatAdmin,
+		Role:        RoleMaintainer,
+		RerunOnEdit: true,
+		Handle: func(state *ProgramState, v *events.Message, args string) {
+			state.QueueReply(v, state.deliveryStatusMessage())
+		},
+	})
+}
+
+// Lists when each Google calendar was last synced
+func (state *ProgramState) calendarStatusMessage() string {
+	if len(state.GoogleCalendars) == 0 {
+		return "```There are no Google calendars```"
 	}
+
+	calendarIDs := []string{}
+	for calendarID := range state.GoogleCalendars {
+		calendarIDs = append(calendarIDs, calendarID)
+	}
+	slices.Sort(calendarIDs)
+
+	var builder strings.Builder
+	builder.WriteString("*Google calendars:*")
+	for _, calendarID := range calendarIDs {
+		syncedAt, eventCount, syncErr := state.GoogleCalendars[calendarID].Status()
+
+		fmt.Fprintf(&builder, "\n\n%s\n", calendarID)
+		if syncedAt.IsZero() {
+			builder.WriteString("Never synced")
+		} else {
+			fmt.Fprintf(&builder, "Last synced %s (%s ago), %d events",
+				syncedAt.In(state.Config.Location).Format("Jan 2 3:04:05 PM"),
+				time.Since(syncedAt).Round(time.Second), eventCount)
+		}
+		if syncErr != nil {
+			fmt.Fprintf(&builder, "\nLast sync failed: ```%s```", syncErr.Error())
+		}
+	}
+
+	return builder.String()
 }
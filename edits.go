@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// If v is an edit of an earlier message, returns the earlier message with the new content, so that
+// commands can be run again on it. Otherwise returns v.
+func editedMessage(v *events.Message) *events.Message {
+	protocol := unwrapMessage(v.Message).GetProtocolMessage()
+	if protocol.GetType() != waE2E.ProtocolMessage_MESSAGE_EDIT || protocol.GetEditedMessage() == nil {
+		return v
+	}
+
+	edited := *v
+	edited.Info.ID = protocol.GetKey().GetID()
+	edited.Message = protocol.GetEditedMessage()
+	edited.IsEdit = true
+	return &edited
+}
+
+// Records that the given part of the reply to v was queued with the given outbox ID
+func (state *ProgramState) rememberReply(v *events.Message, part int, outboxID int64) {
+	_, err := state.DB.ExecContext(state.Ctx,
+		`INSERT OR REPLACE INTO command_replies (chat, message_id, part, outbox_id, created_at) VALUES (?, ?, ?, ?, ?)`,
+		v.Info.Chat.String(), v.Info.ID, part, outboxID, time.Now().Unix())
+	if err != nil {
+		fmt.Printf("Error recording the reply to %v: %v\n", v.Info.ID, err)
+	}
+}
+
+// Edits the earlier reply to the command v with the new messages. Returns false if the reply can't
+// be edited, because there was none, it had a different number of parts, or it is too old.
+func (state *ProgramState) editReplies(v *events.Message, messages []*waE2E.Message) bool {
+	outboxIDs, err := state.replyOutboxIDs(v)
+	if err != nil {
+		state.ReportErrorToMe(err, "editReplies")
+		return false
+	}
+	if len(outboxIDs) != len(messages) {
+		return false
+	}
+
+	// The parts were sent together, so either all of them can still be edited or none can
+	for i, message := range messages {
+		edited, err := state.Outbox.Replace(state.Ctx, outboxIDs[i], message, PriorityInteractive)
+		if err != nil {
+			state.ReportErrorToMe(err, "editReplies")
+			return false
+		}
+		if !edited {
+			return false
+		}
+	}
+
+	fmt.Printf("Edited the reply to %v in chat '%v'\n", v.Info.ID, v.Info.Chat.String())
+	return true
+}
+
+func (state *ProgramState) replyOutboxIDs(v *events.Message) ([]int64, error) {
+	rows, err := state.DB.QueryContext(state.Ctx,
+		`SELECT outbox_id FROM command_replies WHERE chat = ? AND message_id = ? ORDER BY part`,
+		v.Info.Chat.String(), v.Info.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outboxIDs := []int64{}
+	for rows.Next() {
+		var outboxID int64
+		if err := rows.Scan(&outboxID); err != nil {
+			return nil, err
+		}
+		outboxIDs = append(outboxIDs, outboxID)
+	}
+	return outboxIDs, rows.Err()
+}
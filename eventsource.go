@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+	"time"
+
+	"nbot-wa/config"
+)
+
+type ParsedEvent struct {
+	Name     string
+	DateTime time.Time
+
+	// All-day events start at midnight, and are shown without a time
+	AllDay bool
+}
+
+// A backend that minyan times can be read from
+type EventSource interface {
+	// Returns the events starting between dtStart and dtEnd (inclusive), sorted by start time
+	Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error)
+}
+
+// Creates the EventSource configured for site, including its zmanim rules
+func NewEventSource(site *config.Site, googleCalendars map[string]*GoogleCalendarCache, db *sql.DB) (EventSource, error) {
+	var source EventSource
+	switch site.Calendar.Type {
+	case config.CalendarTypeLocal:
+		source = NewLocalEventSource(db, site.ID, site.Location)
+	case config.CalendarTypeICal:
+		source = NewICalEventSource(site.Calendar.URL, site.Location)
+	case config.CalendarTypeCalDAV:
+		source = NewCalDAVEventSource(site.Calendar.URL,
+			site.Calendar.Auth, site.Calendar.Username, site.Calendar.Password,
+			site.Location)
+	case config.CalendarTypeNone:
+		source = NewMemoryEventSource()
+	default:
+		source = googleCalendars[site.Calendar.ID].EventSource(site.Location)
+	}
+
+	if len(site.ZmanimRules) == 0 {
+		return source, nil
+	}
+
+	rules, err := NewZmanimRuleEventSource(site)
+	if err != nil {
+		return nil, err
+	}
+	return MergedEventSource{source, rules}, nil
+}
+
+func sortParsedEvents(parsedEvents []ParsedEvent) {
+	slices.SortStableFunc(parsedEvents, func(a, b ParsedEvent) int {
+		return a.DateTime.Compare(b.DateTime)
+	})
+}
+
+// Returns the events in parsedEvents starting between dtStart and dtEnd (inclusive)
+func eventsInRange(parsedEvents []ParsedEvent, dtStart time.Time, dtEnd time.Time) []ParsedEvent {
+	rtn := []ParsedEvent{}
+	for _, event := range parsedEvents {
+		if !event.DateTime.Before(dtStart) && !event.DateTime.After(dtEnd) {
+			rtn = append(rtn, event)
+		}
+	}
+	return rtn
+}
+
+// An EventSource holding a fixed list of events, for tests and for backends that load everything
+// up front
+type MemoryEventSource struct {
+	mutex  sync.RWMutex
+	events []ParsedEvent
+}
+
+func NewMemoryEventSource(events ...ParsedEvent) *MemoryEventSource {
+	source := &MemoryEventSource{}
+	source.Set(events)
+	return source
+}
+
+// Replaces all of the events in the source
+func (source *MemoryEventSource) Set(events []ParsedEvent) {
+	events = slices.Clone(events)
+	sortParsedEvents(events)
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.events = events
+}
+
+func (source *MemoryEventSource) Add(events ...ParsedEvent) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.events = append(source.events, events...)
+	sortParsedEvents(source.events)
+}
+
+func (source *MemoryEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	source.mutex.RLock()
+	defer source.mutex.RUnlock()
+	return eventsInRange(source.events, dtStart, dtEnd), nil
+}
+
+// An EventSource combining the events of several others
+type MergedEventSource []EventSource
+
+func (sources MergedEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	parsedEvents := []ParsedEvent{}
+	for _, source := range sources {
+		events, err := source.Events(ctx, dtStart, dtEnd)
+		if err != nil {
+			return nil, err
+		}
+		parsedEvents = append(parsedEvents, events...)
+	}
+
+	sortParsedEvents(parsedEvents)
+	return parsedEvents, nil
+}
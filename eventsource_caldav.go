@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nbot-wa/config"
+)
+
+// Reads events from a calendar collection on a CalDAV server (e.g. Radicale or Nextcloud) with a
+// calendar-query REPORT. The server only filters the events, the recurrences are expanded here.
+type CalDAVEventSource struct {
+	url      string
+	client   *http.Client
+	location *time.Location
+}
+
+// Creates a CalDAVEventSource for the calendar collection at url. auth is config.CalendarAuthBasic,
+// config.CalendarAuthDigest, or empty when the server doesn't need a login.
+func NewCalDAVEventSource(url string, auth string, username string, password string, location *time.Location) *CalDAVEventSource {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	switch auth {
+	case config.CalendarAuthBasic:
+		client.Transport = &basicAuthTransport{username: username, password: password}
+	case config.CalendarAuthDigest:
+		client.Transport = &digestAuthTransport{username: username, password: password}
+	}
+
+	return &CalDAVEventSource{
+		url:      url,
+		client:   client,
+		location: location,
+	}
+}
+
+const calDAVQueryTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <C:calendar-data/>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%s" end="%s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>
+`
+
+type calDAVMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func (source *CalDAVEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	// The time-range end is exclusive, while dtEnd is inclusive
+	body := fmt.Sprintf(calDAVQueryTemplate,
+		dtStart.UTC().Format(icalDateTimeUTCFormat),
+		dtEnd.Add(time.Second).UTC().Format(icalDateTimeUTCFormat))
+
+	request, err := http.NewRequestWithContext(ctx, "REPORT", source.url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	request.Header.Set("Depth", "1")
+
+	response, err := source.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("CalDAV REPORT %s: %s", source.url, response.Status)
+	}
+
+	var multistatus calDAVMultistatus
+	if err := xml.NewDecoder(response.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("parsing CalDAV response: %w", err)
+	}
+
+	events := []icalEvent{}
+	for _, resp := range multistatus.Responses {
+		for _, propstat := range resp.Propstats {
+			if propstat.Prop.CalendarData == "" {
+				continue
+			}
+
+			objectEvents, err := parseICalendar(strings.NewReader(propstat.Prop.CalendarData), source.location)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", resp.Href, err)
+			}
+			events = append(events, objectEvents...)
+		}
+	}
+
+	return expandICalEvents(events, dtStart, dtEnd, source.location)
+}
+
+type basicAuthTransport struct {
+	username string
+	password string
+}
+
+func (transport *basicAuthTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.SetBasicAuth(transport.username, transport.password)
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+// Implements HTTP digest authentication (RFC 7616) with MD5 and qop=auth, which is what Radicale
+// and most CalDAV servers offer
+type digestAuthTransport struct {
+	username string
+	password string
+
+	mutex      sync.Mutex
+	challenge  map[string]string
+	nonceCount int
+}
+
+func (transport *digestAuthTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Reuse the last challenge so that most requests only take one round trip
+	authorization, _ := transport.authorization(request)
+	response, err := transport.send(request, authorization)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	if !transport.updateChallenge(response) {
+		return response, nil
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	authorization, _ = transport.authorization(request)
+	return transport.send(request, authorization)
+}
+
+// Sends a copy of request with the given Authorization header
+func (transport *digestAuthTransport) send(request *http.Request, authorization string) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = body
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+// Stores the digest challenge from a 401 response, returning false if there isn't one
+func (transport *digestAuthTransport) updateChallenge(response *http.Response) bool {
+	for _, header := range response.Header.Values("WWW-Authenticate") {
+		scheme, params, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		transport.mutex.Lock()
+		transport.challenge = parseAuthParams(params)
+		transport.nonceCount = 0
+		transport.mutex.Unlock()
+		return true
+	}
+	return false
+}
+
+func (transport *digestAuthTransport) authorization(request *http.Request) (string, bool) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if transport.challenge == nil {
+		return "", false
+	}
+	transport.nonceCount++
+
+	realm := transport.challenge["realm"]
+	nonce := transport.challenge["nonce"]
+	uri := request.URL.RequestURI()
+	nc := fmt.Sprintf("%08x", transport.nonceCount)
+	cnonce := randomHex(8)
+
+	ha1 := md5Hex(transport.username + ":" + realm + ":" + transport.password)
+	ha2 := md5Hex(request.Method + ":" + uri)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, `Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=MD5`,
+		transport.username, realm, nonce, uri)
+
+	if qops := transport.challenge["qop"]; qops != "" {
+		fmt.Fprintf(&builder, `, qop=auth, nc=%s, cnonce=%q, response=%q`,
+			nc, cnonce, md5Hex(ha1+":"+nonce+":"+nc+":"+cnonce+":auth:"+ha2))
+	} else {
+		fmt.Fprintf(&builder, `, response=%q`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+
+	if opaque, ok := transport.challenge["opaque"]; ok {
+		fmt.Fprintf(&builder, `, opaque=%q`, opaque)
+	}
+
+	return builder.String(), true
+}
+
+// Parses the comma-separated key=value or key="value" parameters of an authentication challenge
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var buffer bytes.Buffer
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				buffer.WriteByte(rest[i])
+			}
+			value = buffer.String()
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+			rest = "," + rest
+		}
+
+		params[key] = value
+		s = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nbot-wa/config"
+)
+
+// A stand-in CalDAV server which only accepts digest logins, and answers a calendar-query REPORT
+// with the fixture calendar. Returns the time ranges queried.
+func newTestCalDAVServer(t *testing.T, username string, password string) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	calendarData, err := os.ReadFile("testdata/minyan.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const realm = "Radicale"
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	var mutex sync.Mutex
+	timeRanges := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		auth := parseAuthParams(params)
+		ha1 := md5Hex(username + ":" + realm + ":" + password)
+		ha2 := md5Hex(r.Method + ":" + auth["uri"])
+		expected := md5Hex(ha1 + ":" + nonce + ":" + auth["nc"] + ":" + auth["cnonce"] + ":auth:" + ha2)
+		if scheme != "Digest" || auth["username"] != username || auth["nonce"] != nonce || auth["response"] != expected {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm=%q, nonce=%q, qop="auth", algorithm=MD5`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != "REPORT" || r.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query struct {
+			TimeRange struct {
+				Start string `xml:"start,attr"`
+				End   string `xml:"end,attr"`
+			} `xml:"filter>comp-filter>comp-filter>time-range"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &query); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		timeRanges = append(timeRanges, query.TimeRange.Start+"/"+query.TimeRange.End)
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<multistatus xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <response>
+    <href>/gabbai/minyan/minyan.ics</href>
+    <propstat>
+      <prop><C:calendar-data>%s</C:calendar-data></prop>
+      <status>HTTP/1.1 200 OK</status>
+    </propstat>
+  </response>
+</multistatus>
+`, xmlEscape(string(calendarData)))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Clone(timeRanges)
+	}
+}
+
+func xmlEscape(s string) string {
+	var builder strings.Builder
+	xml.EscapeText(&builder, []byte(s))
+	return builder.String()
+}
+
+func TestCalDAVEventSourceWithDigestAuth(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, timeRanges := newTestCalDAVServer(t, "gabbai", "hunter2")
+
+	source := NewCalDAVEventSource(server.URL+"/gabbai/minyan/", config.CalendarAuthDigest, "gabbai", "hunter2", location)
+	dtStart := time.Date(2025, 3, 6, 0, 0, 0, 0, location)
+	events, err := source.Events(context.Background(), dtStart, endOfDate(dtStart))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The end of the range is exclusive in CalDAV, and inclusive in Events
+	expected := "20250306T050000Z/20250307T050000Z"
+	if queried := timeRanges(); len(queried) != 1 || queried[0] != expected {
+		t.Errorf("Expected one query for %s, got %v", expected, queried)
+	}
+
+	if len(events) != 1 || events[0].Name != "Shacharis" || !events[0].DateTime.Equal(time.Date(2025, 3, 6, 6, 30, 0, 0, location)) {
+		t.Errorf("Expected the moved Shacharis, got %v", events)
+	}
+}
+
+func TestCalDAVEventSourceWrongPassword(t *testing.T) {
+	server, _ := newTestCalDAVServer(t, "gabbai", "hunter2")
+
+	source := NewCalDAVEventSource(server.URL+"/gabbai/minyan/", config.CalendarAuthDigest, "gabbai", "wrong", time.UTC)
+	if _, err := source.Events(context.Background(), time.Now(), time.Now().Add(time.Hour)); err == nil {
+		t.Error("Expected an error with the wrong password")
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// How often Google calendars are synced in the background
+	googleCalendarSyncInterval = 5 * time.Minute
+	googleCalendarSyncTimeout  = 30 * time.Second
+)
+
+// A local copy of a public Google Calendar, kept up to date with incremental syncs (sync tokens)
+// and stored in the database so that it survives restarts. Recurring events are stored once and
+// expanded locally, like iCalendar files.
+type GoogleCalendarCache struct {
+	service    *calendar.EventsService
+	db         *sql.DB
+	calendarID string
+
+	// Held for the whole of a sync, so that only one runs at a time
+	syncMutex sync.Mutex
+
+	mutex     sync.Mutex
+	events    map[string]*calendar.Event // Keyed by event ID
+	syncToken string
+	syncedAt  time.Time
+	syncErr   error
+	// The events converted for expansion, keyed by the location of the floating times
+	parsed map[*time.Location][]icalEvent
+}
+
+// Creates a cache for calendarID, starting from the copy in the database if there is one
+func NewGoogleCalendarCache(ctx context.Context, service *calendar.EventsService, db *sql.DB, calendarID string) (*GoogleCalendarCache, error) {
+	cache := &GoogleCalendarCache{
+		service:    service,
+		db:         db,
+		calendarID: calendarID,
+		events:     map[string]*calendar.Event{},
+	}
+
+	var syncedAt int64
+	err := db.QueryRowContext(ctx,
+		`SELECT sync_token, synced_at FROM google_calendar_sync WHERE calendar_id = ?`,
+		calendarID).Scan(&cache.syncToken, &syncedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cache.syncedAt = time.Unix(syncedAt, 0)
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT data FROM google_calendar_events WHERE calendar_id = ?`,
+		calendarID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var event calendar.Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("cached event in %s: %w", calendarID, err)
+		}
+		cache.events[event.Id] = &event
+	}
+
+	return cache, rows.Err()
+}
+
+func (cache *GoogleCalendarCache) CalendarID() string {
+	return cache.calendarID
+}
+
+// Returns when the cache was last synced (zero if never), how many events it holds, and the error
+// from the last sync if it failed
+func (cache *GoogleCalendarCache) Status() (syncedAt time.Time, eventCount int, syncErr error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.syncedAt, len(cache.events), cache.syncErr
+}
+
+// Fetches the changes since the last sync, or the whole calendar if it has never been synced or the
+// sync token has expired
+func (cache *GoogleCalendarCache) Sync(ctx context.Context) error {
+	cache.syncMutex.Lock()
+	defer cache.syncMutex.Unlock()
+
+	err := cache.sync(ctx)
+
+	cache.mutex.Lock()
+	cache.syncErr = err
+	cache.mutex.Unlock()
+
+	return err
+}
+
+func (cache *GoogleCalendarCache) sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, googleCalendarSyncTimeout)
+	defer cancel()
+
+	cache.mutex.Lock()
+	syncToken := cache.syncToken
+	cache.mutex.Unlock()
+
+	items, nextSyncToken, err := cache.list(ctx, syncToken)
+
+	var apiErr *googleapi.Error
+	if syncToken != "" && errors.As(err, &apiErr) && apiErr.Code == http.StatusGone {
+		// The sync token has expired, so start again from scratch
+		syncToken = ""
+		items, nextSyncToken, err = cache.list(ctx, syncToken)
+	}
+	if err != nil {
+		return fmt.Errorf("syncing Google calendar %s: %w", cache.calendarID, err)
+	}
+
+	fullSync := syncToken == ""
+	syncedAt := time.Now()
+	if err := cache.store(ctx, items, fullSync, nextSyncToken, syncedAt); err != nil {
+		return fmt.Errorf("storing Google calendar %s: %w", cache.calendarID, err)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if fullSync {
+		cache.events = map[string]*calendar.Event{}
+	}
+	for _, item := range items {
+		if isDeletedGoogleEvent(item) {
+			delete(cache.events, item.Id)
+		} else {
+			cache.events[item.Id] = item
+		}
+	}
+	cache.syncToken = nextSyncToken
+	cache.syncedAt = syncedAt
+	cache.parsed = nil
+
+	return nil
+}
+
+// Lists all of the events, or the ones changed since syncToken, returning the next sync token
+func (cache *GoogleCalendarCache) list(ctx context.Context, syncToken string) ([]*calendar.Event, string, error) {
+	items := []*calendar.Event{}
+	pageToken := ""
+
+	for {
+		// Sync tokens can't be combined with a time range, and recurring events are expanded
+		// locally so that the calendar doesn't have to be fetched again for each range
+		call := cache.service.List(cache.calendarID).
+			SingleEvents(false).
+			MaxResults(2500).
+			Context(ctx)
+		if syncToken != "" {
+			call = call.SyncToken(syncToken)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		events, err := call.Do()
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, events.Items...)
+
+		if events.NextPageToken == "" {
+			return items, events.NextSyncToken, nil
+		}
+		pageToken = events.NextPageToken
+	}
+}
+
+// Saves a sync to the database, replacing everything for a full sync
+func (cache *GoogleCalendarCache) store(ctx context.Context, items []*calendar.Event, fullSync bool, syncToken string, syncedAt time.Time) error {
+	tx, err := cache.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if fullSync {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM google_calendar_events WHERE calendar_id = ?`, cache.calendarID); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		if isDeletedGoogleEvent(item) {
+			_, err = tx.ExecContext(ctx,
+				`DELETE FROM google_calendar_events WHERE calendar_id = ? AND event_id = ?`,
+				cache.calendarID, item.Id)
+		} else {
+			var data []byte
+			data, err = json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT OR REPLACE INTO google_calendar_events (calendar_id, event_id, data) VALUES (?, ?, ?)`,
+				cache.calendarID, item.Id, string(data))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO google_calendar_sync (calendar_id, sync_token, synced_at) VALUES (?, ?, ?)`,
+		cache.calendarID, syncToken, syncedAt.Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// A deleted event is removed from the cache. Cancelled instances of a recurring event are kept,
+// since they remove that occurrence.
+func isDeletedGoogleEvent(event *calendar.Event) bool {
+	return event.Status == "cancelled" && event.RecurringEventId == ""
+}
+
+// Returns the cached events converted for expansion, with floating times in location
+func (cache *GoogleCalendarCache) icalEvents(location *time.Location) ([]icalEvent, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if events, ok := cache.parsed[location]; ok {
+		return events, nil
+	}
+
+	events := make([]icalEvent, 0, len(cache.events))
+	for _, item := range cache.events {
+		event, err := googleEventToICal(item, location)
+		if err != nil {
+			return nil, fmt.Errorf("event %q in %s: %w", item.Id, cache.calendarID, err)
+		}
+		events = append(events, event)
+	}
+
+	if cache.parsed == nil {
+		cache.parsed = map[*time.Location][]icalEvent{}
+	}
+	cache.parsed[location] = events
+	return events, nil
+}
+
+// Returns an EventSource reading the cache, with floating times and all-day events in location.
+// It only calls Google if the calendar has never been synced.
+func (cache *GoogleCalendarCache) EventSource(location *time.Location) EventSource {
+	return &googleCalendarCacheSource{
+		cache:    cache,
+		location: location,
+	}
+}
+
+type googleCalendarCacheSource struct {
+	cache    *GoogleCalendarCache
+	location *time.Location
+}
+
+func (source *googleCalendarCacheSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	if syncedAt, _, _ := source.cache.Status(); syncedAt.IsZero() {
+		if err := source.cache.Sync(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	events, err := source.cache.icalEvents(source.location)
+	if err != nil {
+		return nil, err
+	}
+
+	return expandICalEvents(events, dtStart, dtEnd, source.location)
+}
+
+// Converts a Google Calendar event to an iCalendar one. Google gives the recurrence as iCalendar
+// lines (RRULE, EXDATE and RDATE), so they are parsed the same way as an .ics file.
+func googleEventToICal(event *calendar.Event, location *time.Location) (icalEvent, error) {
+	start := event.Start
+	if start == nil {
+		// Cancelled instances only have the start they replace
+		start = event.OriginalStartTime
+	}
+	if start == nil {
+		return icalEvent{}, errors.New("missing start")
+	}
+
+	dtStart, err := formatGoogleEventDateTime(start)
+	if err != nil {
+		return icalEvent{}, err
+	}
+
+	var builder strings.Builder
+	builder.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//nbot-wa//EN\r\nBEGIN:VEVENT\r\n")
+	builder.WriteString("DTSTART" + dtStart + "\r\n")
+	if event.OriginalStartTime != nil {
+		recurrenceID, err := formatGoogleEventDateTime(event.OriginalStartTime)
+		if err != nil {
+			return icalEvent{}, err
+		}
+		builder.WriteString("RECURRENCE-ID" + recurrenceID + "\r\n")
+	}
+	for _, line := range event.Recurrence {
+		builder.WriteString(line + "\r\n")
+	}
+	builder.WriteString("END:VEVENT\r\nEND:VCALENDAR\r\n")
+
+	events, err := parseICalendar(strings.NewReader(builder.String()), location)
+	if err != nil {
+		return icalEvent{}, err
+	}
+
+	parsed := events[0]
+	// Instances are matched to their recurring event by UID
+	parsed.uid = event.Id
+	if event.RecurringEventId != "" {
+		parsed.uid = event.RecurringEventId
+	}
+	parsed.summary = event.Summary
+	parsed.cancelled = event.Status == "cancelled"
+
+	return parsed, nil
+}
+
+// Formats a Google event time as the parameters and value of an iCalendar property, e.g.
+// ";TZID=America/New_York:20250101T090000"
+func formatGoogleEventDateTime(t *calendar.EventDateTime) (string, error) {
+	if t.DateTime == "" {
+		date, err := time.Parse(time.DateOnly, t.Date)
+		if err != nil {
+			return "", err
+		}
+		return ";VALUE=DATE:" + date.Format(icalDateFormat), nil
+	}
+
+	instant, err := time.Parse(time.RFC3339, t.DateTime)
+	if err != nil {
+		return "", err
+	}
+
+	if t.TimeZone == "" {
+		return ":" + instant.UTC().Format(icalDateTimeUTCFormat), nil
+	}
+
+	location, err := time.LoadLocation(t.TimeZone)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(";TZID=%s:%s", t.TimeZone, instant.In(location).Format(icalDateTimeFormat)), nil
+}
+
+// Syncs the Google calendars now and then every googleCalendarSyncInterval
+func (state *ProgramState) RegisterCalendarSync() error {
+	for _, cache := range state.GoogleCalendars {
+		_, err := state.MinyanScheduler.NewJob(
+			gocron.DurationJob(googleCalendarSyncInterval),
+			gocron.NewTask(state.syncGoogleCalendar, cache),
+			gocron.WithStartAt(gocron.WithStartImmediately()),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (state *ProgramState) syncGoogleCalendar(cache *GoogleCalendarCache) {
+	_, _, previousErr := cache.Status()
+
+	err := cache.Sync(state.Ctx)
+	if err == nil {
+		return
+	}
+
+	// The cached events are still used, so only report the first failure in a row
+	fmt.Println("Warning:", err)
+	if previousErr == nil {
+		state.ReportErrorToMe(err, "syncGoogleCalendar")
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/teambition/rrule-go"
+)
+
+const (
+	// How long a downloaded or read .ics file is used before it is loaded again
+	icalURLMaxAge  = 10 * time.Minute
+	icalFileMaxAge = 1 * time.Minute
+
+	// Recurring VTIMEZONE changes are only expanded from this year on
+	vtimezoneMinYear = 1970
+
+	icalDateFormat        = "20060102"
+	icalDateTimeFormat    = "20060102T150405"
+	icalDateTimeUTCFormat = "20060102T150405Z"
+)
+
+var rUTCUntil = regexp.MustCompile(`(?i)UNTIL=(\d{8}T\d{6}Z)`)
+
+// Reads events from an iCalendar (.ics) file on disk or at a URL. Recurring events are expanded
+// with their RRULE, RDATE and EXDATE properties and any overridden instances (RECURRENCE-ID).
+type ICalEventSource struct {
+	location *time.Location
+	open     func(ctx context.Context) (io.ReadCloser, error)
+	maxAge   time.Duration
+
+	mutex    sync.Mutex
+	events   []icalEvent
+	loadedAt time.Time
+}
+
+// Creates an ICalEventSource reading from source, which is either an http(s) URL or a file path.
+// Floating times and all-day events are placed in location.
+func NewICalEventSource(source string, location *time.Location) *ICalEventSource {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "webcal://") {
+		return NewICalURLEventSource(strings.Replace(source, "webcal://", "https://", 1), http.DefaultClient, location)
+	}
+	return NewICalFileEventSource(source, location)
+}
+
+func NewICalFileEventSource(path string, location *time.Location) *ICalEventSource {
+	return &ICalEventSource{
+		location: location,
+		maxAge:   icalFileMaxAge,
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}
+}
+
+func NewICalURLEventSource(url string, client *http.Client, location *time.Location) *ICalEventSource {
+	return &ICalEventSource{
+		location: location,
+		maxAge:   icalURLMaxAge,
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			response, err := client.Do(request)
+			if err != nil {
+				return nil, err
+			}
+			if response.StatusCode != http.StatusOK {
+				response.Body.Close()
+				return nil, fmt.Errorf("fetching %s: %s", url, response.Status)
+			}
+			return response.Body, nil
+		},
+	}
+}
+
+func (source *ICalEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	events, err := source.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return expandICalEvents(events, dtStart, dtEnd, source.location)
+}
+
+// Returns the parsed events, reloading them if they are too old. If reloading fails, the previous
+// events are used if there are any.
+func (source *ICalEventSource) load(ctx context.Context) ([]icalEvent, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.events != nil && time.Since(source.loadedAt) < source.maxAge {
+		return source.events, nil
+	}
+
+	events, err := source.read(ctx)
+	if err != nil {
+		if source.events != nil {
+			fmt.Println("Warning: could not reload iCalendar, using the previous version:", err)
+			return source.events, nil
+		}
+		return nil, err
+	}
+
+	source.events = events
+	source.loadedAt = time.Now()
+	return events, nil
+}
+
+func (source *ICalEventSource) read(ctx context.Context) ([]icalEvent, error) {
+	reader, err := source.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return parseICalendar(reader, source.location)
+}
+
+// A VEVENT, with its times already resolved
+type icalEvent struct {
+	uid       string
+	summary   string
+	start     icalTime
+	cancelled bool
+
+	rule    *rrule.ROption
+	rdates  []time.Time
+	exdates []time.Time
+
+	// For an overridden instance of a recurring event, the start of the instance it replaces
+	recurrenceID *time.Time
+}
+
+type icalTime struct {
+	// The wall clock time, with the location set to UTC
+	wall   time.Time
+	zone   icalZone
+	allDay bool
+}
+
+func (t icalTime) instant() time.Time {
+	return t.zone.instant(t.wall)
+}
+
+// Converts between wall clock times (expressed in UTC) and instants. Recurrences are expanded on
+// wall clock times, so that they stay at the same local time across DST changes.
+type icalZone interface {
+	instant(wall time.Time) time.Time
+	wall(instant time.Time) time.Time
+}
+
+type locationZone struct {
+	location *time.Location
+}
+
+func (zone locationZone) instant(wall time.Time) time.Time {
+	return time.Date(wall.Year(), wall.Month(), wall.Day(),
+		wall.Hour(), wall.Minute(), wall.Second(), 0,
+		zone.location)
+}
+
+func (zone locationZone) wall(instant time.Time) time.Time {
+	local := instant.In(zone.location)
+	return time.Date(local.Year(), local.Month(), local.Day(),
+		local.Hour(), local.Minute(), local.Second(), 0,
+		time.UTC)
+}
+
+// A zone defined by a VTIMEZONE component, for TZIDs that aren't IANA names (e.g. the Windows
+// names used in Outlook exports)
+type vtimezoneZone struct {
+	observances []vtimezoneObservance
+}
+
+// A STANDARD or DAYLIGHT sub-component
+type vtimezoneObservance struct {
+	// Wall clock times of the changes to this observance, in offsetFrom
+	onsets     rrule.Set
+	offsetFrom time.Duration
+	offsetTo   time.Duration
+}
+
+// Returns the UTC offset in effect at instant
+func (zone *vtimezoneZone) offsetAt(instant time.Time) time.Duration {
+	var latestOnset time.Time
+	offset := zone.observances[0].offsetFrom
+
+	for i := range zone.observances {
+		observance := &zone.observances[i]
+		onsetWall := observance.onsets.Before(instant.Add(observance.offsetFrom), true)
+		if onsetWall.IsZero() {
+			continue
+		}
+
+		onset := onsetWall.Add(-observance.offsetFrom)
+		if latestOnset.IsZero() || onset.After(latestOnset) {
+			latestOnset = onset
+			offset = observance.offsetTo
+		}
+	}
+
+	return offset
+}
+
+func (zone *vtimezoneZone) instant(wall time.Time) time.Time {
+	for _, observance := range zone.observances {
+		candidate := wall.Add(-observance.offsetTo)
+		if zone.offsetAt(candidate) == observance.offsetTo {
+			return candidate
+		}
+	}
+
+	// The wall clock time was skipped by a change to DST
+	return wall.Add(-zone.offsetAt(wall))
+}
+
+func (zone *vtimezoneZone) wall(instant time.Time) time.Time {
+	return instant.UTC().Add(zone.offsetAt(instant))
+}
+
+// Parses an iCalendar stream. Floating times and all-day events are placed in location.
+func parseICalendar(reader io.Reader, location *time.Location) ([]icalEvent, error) {
+	calendar, err := ical.NewDecoder(reader).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("parsing iCalendar: %w", err)
+	}
+
+	vtimezones := map[string]*ical.Component{}
+	for _, child := range calendar.Children {
+		if child.Name == ical.CompTimezone {
+			if tzid := child.Props.Get(ical.PropTimezoneID); tzid != nil {
+				vtimezones[tzid.Value] = child
+			}
+		}
+	}
+
+	zones := map[string]icalZone{}
+	zoneForTZID := func(tzid string) (icalZone, error) {
+		if zone, ok := zones[tzid]; ok {
+			return zone, nil
+		}
+
+		var zone icalZone
+		if loc, err := time.LoadLocation(tzid); err == nil {
+			zone = locationZone{loc}
+		} else if vtimezone, ok := vtimezones[tzid]; ok {
+			zone, err = parseVTimezone(vtimezone)
+			if err != nil {
+				return nil, fmt.Errorf("VTIMEZONE %q: %w", tzid, err)
+			}
+		} else {
+			return nil, fmt.Errorf("unknown TZID %q", tzid)
+		}
+
+		zones[tzid] = zone
+		return zone, nil
+	}
+
+	parseTimes := func(prop *ical.Prop) ([]icalTime, error) {
+		zone := icalZone(locationZone{location})
+		if tzid := prop.Params.Get(ical.PropTimezoneID); tzid != "" {
+			var err error
+			zone, err = zoneForTZID(tzid)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return parseICalTimes(prop, zone)
+	}
+
+	events := []icalEvent{}
+	for _, child := range calendar.Children {
+		if child.Name != ical.CompEvent {
+			continue
+		}
+
+		event, err := parseICalEvent(child, parseTimes)
+		if err != nil {
+			uid, _ := child.Props.Text(ical.PropUID)
+			return nil, fmt.Errorf("event %q: %w", uid, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func parseICalEvent(component *ical.Component, parseTimes func(*ical.Prop) ([]icalTime, error)) (icalEvent, error) {
+	var event icalEvent
+	var err error
+
+	event.uid, _ = component.Props.Text(ical.PropUID)
+	event.summary, _ = component.Props.Text(ical.PropSummary)
+
+	if status := component.Props.Get(ical.PropStatus); status != nil {
+		event.cancelled = strings.EqualFold(status.Value, string(ical.EventCancelled))
+	}
+
+	startProp := component.Props.Get(ical.PropDateTimeStart)
+	if startProp == nil {
+		return icalEvent{}, errors.New("missing DTSTART")
+	}
+	starts, err := parseTimes(startProp)
+	if err != nil {
+		return icalEvent{}, fmt.Errorf("DTSTART: %w", err)
+	}
+	event.start = starts[0]
+
+	if rruleProp := component.Props.Get(ical.PropRecurrenceRule); rruleProp != nil {
+		event.rule, err = parseICalRecurrenceRule(rruleProp.Value, event.start)
+		if err != nil {
+			return icalEvent{}, err
+		}
+	}
+
+	for _, prop := range component.Props.Values(ical.PropRecurrenceDates) {
+		times, err := parseTimes(&prop)
+		if err != nil {
+			return icalEvent{}, fmt.Errorf("RDATE: %w", err)
+		}
+		for _, t := range times {
+			event.rdates = append(event.rdates, t.instant())
+		}
+	}
+
+	for _, prop := range component.Props.Values(ical.PropExceptionDates) {
+		times, err := parseTimes(&prop)
+		if err != nil {
+			return icalEvent{}, fmt.Errorf("EXDATE: %w", err)
+		}
+		for _, t := range times {
+			event.exdates = append(event.exdates, t.instant())
+		}
+	}
+
+	if prop := component.Props.Get(ical.PropRecurrenceID); prop != nil {
+		times, err := parseTimes(prop)
+		if err != nil {
+			return icalEvent{}, fmt.Errorf("RECURRENCE-ID: %w", err)
+		}
+		recurrenceID := times[0].instant()
+		event.recurrenceID = &recurrenceID
+	}
+
+	return event, nil
+}
+
+// Parses the RRULE of an event starting at start, so that it can be expanded on wall clock times
+func parseICalRecurrenceRule(value string, start icalTime) (*rrule.ROption, error) {
+	option, err := rrule.StrToROptionInLocation(value, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("RRULE: %w", err)
+	}
+
+	if match := rUTCUntil.FindStringSubmatch(value); match != nil {
+		// A UTC UNTIL is an instant, which has to be converted to the event's wall clock
+		until, err := time.Parse(icalDateTimeUTCFormat, strings.ToUpper(match[1]))
+		if err != nil {
+			return nil, fmt.Errorf("RRULE UNTIL: %w", err)
+		}
+		option.Until = start.zone.wall(until)
+	}
+
+	option.Dtstart = start.wall
+	return option, nil
+}
+
+// Parses a DATE or DATE-TIME property, which may hold a comma-separated list of values
+func parseICalTimes(prop *ical.Prop, zone icalZone) ([]icalTime, error) {
+	times := []icalTime{}
+
+	for _, value := range strings.Split(prop.Value, ",") {
+		value = strings.TrimSpace(value)
+		if prop.ValueType() == ical.ValuePeriod {
+			// Only the start of a period matters
+			value, _, _ = strings.Cut(value, "/")
+		}
+
+		switch len(value) {
+		case len(icalDateFormat):
+			wall, err := time.Parse(icalDateFormat, value)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, icalTime{wall: wall, zone: zone, allDay: true})
+
+		case len(icalDateTimeFormat):
+			wall, err := time.Parse(icalDateTimeFormat, value)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, icalTime{wall: wall, zone: zone})
+
+		case len(icalDateTimeUTCFormat):
+			wall, err := time.Parse(icalDateTimeUTCFormat, strings.ToUpper(value))
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, icalTime{wall: wall, zone: locationZone{time.UTC}})
+
+		default:
+			return nil, fmt.Errorf("invalid date or time %q", value)
+		}
+	}
+
+	if len(times) == 0 {
+		return nil, errors.New("no value")
+	}
+	return times, nil
+}
+
+func parseVTimezone(component *ical.Component) (*vtimezoneZone, error) {
+	zone := &vtimezoneZone{}
+
+	for _, child := range component.Children {
+		if child.Name != ical.CompTimezoneStandard && child.Name != ical.CompTimezoneDaylight {
+			continue
+		}
+
+		offsetFrom, err := parseUTCOffset(child.Props.Get(ical.PropTimezoneOffsetFrom))
+		if err != nil {
+			return nil, fmt.Errorf("TZOFFSETFROM: %w", err)
+		}
+		offsetTo, err := parseUTCOffset(child.Props.Get(ical.PropTimezoneOffsetTo))
+		if err != nil {
+			return nil, fmt.Errorf("TZOFFSETTO: %w", err)
+		}
+
+		observance := vtimezoneObservance{
+			offsetFrom: offsetFrom,
+			offsetTo:   offsetTo,
+		}
+
+		// Observance times are always local, in offsetFrom
+		fromZone := locationZone{time.FixedZone("", int(offsetFrom.Seconds()))}
+
+		startProp := child.Props.Get(ical.PropDateTimeStart)
+		if startProp == nil {
+			return nil, errors.New("missing DTSTART")
+		}
+		starts, err := parseICalTimes(startProp, fromZone)
+		if err != nil {
+			return nil, fmt.Errorf("DTSTART: %w", err)
+		}
+		observance.onsets.RDate(starts[0].wall)
+
+		if rruleProp := child.Props.Get(ical.PropRecurrenceRule); rruleProp != nil {
+			option, err := parseICalRecurrenceRule(rruleProp.Value, starts[0])
+			if err != nil {
+				return nil, err
+			}
+			if option.Freq == rrule.YEARLY && option.Dtstart.Year() < vtimezoneMinYear {
+				// Exports often start their rules in 1601, and rrule-go gives up iterating long
+				// before reaching the present
+				dtstart := option.Dtstart
+				option.Dtstart = time.Date(vtimezoneMinYear, dtstart.Month(), dtstart.Day(),
+					dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, time.UTC)
+			}
+			rule, err := rrule.NewRRule(*option)
+			if err != nil {
+				return nil, fmt.Errorf("RRULE: %w", err)
+			}
+			observance.onsets.RRule(rule)
+		}
+
+		for _, prop := range child.Props.Values(ical.PropRecurrenceDates) {
+			rdates, err := parseICalTimes(&prop, fromZone)
+			if err != nil {
+				return nil, fmt.Errorf("RDATE: %w", err)
+			}
+			for _, rdate := range rdates {
+				observance.onsets.RDate(rdate.wall)
+			}
+		}
+
+		zone.observances = append(zone.observances, observance)
+	}
+
+	if len(zone.observances) == 0 {
+		return nil, errors.New("no STANDARD or DAYLIGHT components")
+	}
+	return zone, nil
+}
+
+// Parses a UTC offset like "-0500" or "+013000"
+func parseUTCOffset(prop *ical.Prop) (time.Duration, error) {
+	if prop == nil {
+		return 0, errors.New("missing")
+	}
+
+	value := prop.Value
+	if len(value) != 5 && len(value) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset %q", value)
+	}
+
+	layout := "-0700"
+	if len(value) == 7 {
+		layout = "-070000"
+	}
+
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid UTC offset %q", value)
+	}
+
+	_, offset := t.Zone()
+	return time.Duration(offset) * time.Second, nil
+}
+
+// Returns the occurrences of events that start between dtStart and dtEnd (inclusive)
+func expandICalEvents(events []icalEvent, dtStart time.Time, dtEnd time.Time, location *time.Location) ([]ParsedEvent, error) {
+	// Overridden instances replace the occurrence of the recurring event with the same start
+	overridden := map[string]map[int64]bool{}
+	for _, event := range events {
+		if event.recurrenceID != nil {
+			if overridden[event.uid] == nil {
+				overridden[event.uid] = map[int64]bool{}
+			}
+			overridden[event.uid][event.recurrenceID.Unix()] = true
+		}
+	}
+
+	parsedEvents := []ParsedEvent{}
+	addOccurrence := func(event *icalEvent, start time.Time) {
+		if start.Before(dtStart) || start.After(dtEnd) {
+			return
+		}
+
+		parsedEvents = append(parsedEvents, ParsedEvent{
+			Name:     strings.TrimSpace(event.summary),
+			DateTime: start.In(location),
+			AllDay:   event.start.allDay,
+		})
+	}
+
+	for i := range events {
+		event := &events[i]
+		if event.cancelled {
+			continue
+		}
+
+		if event.recurrenceID != nil || (event.rule == nil && len(event.rdates) == 0) {
+			addOccurrence(event, event.start.instant())
+			continue
+		}
+
+		var set rrule.Set
+		set.RDate(event.start.wall)
+		if event.rule != nil {
+			rule, err := rrule.NewRRule(*event.rule)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: RRULE: %w", event.uid, err)
+			}
+			set.RRule(rule)
+		}
+
+		// Expand on wall clock times with some margin, since the UTC offset isn't known yet
+		wallStart := event.start.zone.wall(dtStart).AddDate(0, 0, -1)
+		wallEnd := event.start.zone.wall(dtEnd).AddDate(0, 0, 1)
+
+		occurrences := []time.Time{}
+		for _, wall := range set.Between(wallStart, wallEnd, true) {
+			occurrences = append(occurrences, event.start.zone.instant(wall))
+		}
+		occurrences = append(occurrences, event.rdates...)
+
+		seen := map[int64]bool{}
+		for _, occurrence := range occurrences {
+			key := occurrence.Unix()
+			if seen[key] || overridden[event.uid][key] || containsInstant(event.exdates, occurrence) {
+				continue
+			}
+			seen[key] = true
+			addOccurrence(event, occurrence)
+		}
+	}
+
+	sortParsedEvents(parsedEvents)
+	return parsedEvents, nil
+}
+
+func containsInstant(times []time.Time, t time.Time) bool {
+	for _, other := range times {
+		if other.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestICalEventSourceExpandsRecurrences(t *testing.T) {
+	// The times in the file are in New York
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2025, 3, day, hour, minute, 0, 0, location)
+	}
+
+	// The file's timezone isn't a known name and the source's location is UTC, so the times are
+	// only right if the VTIMEZONE is used. Daylight saving time starts on March 9th, and the times
+	// must stay at 7:00 across it. All-day events are placed in the source's location.
+	source := NewICalFileEventSource("testdata/minyan.ics", time.UTC)
+	events, err := source.Events(context.Background(), at(4, 0, 0), endOfDate(at(11, 0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ParsedEvent{
+		{Name: "Shacharis", DateTime: at(4, 7, 0)},
+		// March 5th is excluded, and March 6th is moved
+		{Name: "Shacharis", DateTime: at(6, 6, 30)},
+		{Name: "Shacharis", DateTime: at(7, 7, 0)},
+		{Name: "Mincha", DateTime: at(7, 13, 30)},
+		{Name: "Shacharis", DateTime: at(8, 7, 0)},
+		{Name: "Shacharis", DateTime: at(9, 7, 0)},
+		{Name: "Fast Day", DateTime: time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC), AllDay: true},
+		{Name: "Shacharis", DateTime: at(10, 7, 0)},
+		// From the RDATE
+		{Name: "Mincha", DateTime: at(10, 13, 30)},
+		{Name: "Shacharis", DateTime: at(11, 7, 0)},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i, event := range events {
+		if event.Name != expected[i].Name || !event.DateTime.Equal(expected[i].DateTime) || event.AllDay != expected[i].AllDay {
+			t.Errorf("Event %d: expected %v, got %v", i, expected[i], event)
+		}
+	}
+}
@@ -5,15 +5,18 @@ go 1.24.0
 toolchain go1.24.6
 
 require (
+	github.com/dlclark/regexp2 v1.11.5
+	github.com/emersion/go-ical v0.0.0-20250609112844-439c63cef608
 	github.com/go-co-op/gocron/v2 v2.19.0
 	github.com/hebcal/hdate v1.2.1
 	github.com/hebcal/hebcal-go v0.10.9
 	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/mdp/qrterminal/v3 v3.2.1
+	github.com/teambition/rrule-go v1.8.2
 	go.mau.fi/whatsmeow v0.0.0-20260116142645-06f473759141
 	google.golang.org/api v0.260.0
 	google.golang.org/protobuf v1.36.11
-	github.com/dlclark/regexp2 v1.11.5
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"nbot-wa/constants"
+	"nbot-wa/config"
 	"nbot-wa/util"
 
 	"github.com/go-co-op/gocron/v2"
@@ -19,6 +23,7 @@ import (
 	"google.golang.org/api/option"
 
 	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
@@ -26,14 +31,32 @@ import (
 )
 
 type ProgramState struct {
-	Client                *whatsmeow.Client
-	MessageQueue          chan MessageToSend
-	CalendarEventsService *calendar.EventsService
-	MinyanScheduler       gocron.Scheduler
-	Ctx                   context.Context
+	Config          *config.Config
+	Client          Messenger
+	Outbox          *Outbox
+	EventSources    map[string]EventSource          // Keyed by site ID
+	GoogleCalendars map[string]*GoogleCalendarCache // Keyed by calendar ID
+	DB              *sql.DB
+	MinyanScheduler gocron.Scheduler
+	Commands        *CommandRegistry
+	DeviceStore     *store.Device // The bot's login, whose LID is only known once it has paired
+	Ctx             context.Context
+
+	// Cancels Ctx
+	cancel context.CancelFunc
+	// Set once shutdown starts, after which events are ignored
+	shuttingDown atomic.Bool
+	// Messages being sent by the message queue
+	sends sync.WaitGroup
+	// Closed when the message queue's loop has stopped
+	queueStopped chan struct{}
 }
 
 func (state *ProgramState) HandleEvent(evt interface{}) {
+	if state.shuttingDown.Load() {
+		return
+	}
+
 	switch v := evt.(type) {
 	case *events.Message:
 		fmt.Printf("Received message in '%v'\n", v.Info.Chat.String())
@@ -42,17 +65,15 @@ func (state *ProgramState) HandleEvent(evt interface{}) {
 			return
 		}
 
-		if !v.Info.IsGroup || slices.Contains(constants.ChatIDsToRead(), v.Info.Chat) {
+		if !v.Info.IsGroup || slices.Contains(state.Config.ChatIDsToRead(), v.Info.Chat) {
 			state.Client.MarkRead(state.Ctx, []string{v.Info.ID}, time.Now(), v.Info.Chat, v.Info.Sender, types.ReceiptTypeRead)
 		}
 
-		if (v.Info.Chat == constants.ChatIDMe()) || (v.Info.Chat == constants.ChatIDBotTest()) {
-			state.HandleDebugMessage(v)
-		}
+		// An edited command is run again, as if the original message had said the new text
+		state.HandleCommand(editedMessage(v))
 
-		if !v.Info.IsGroup || (v.Info.Chat == constants.ChatIDMinyan()) || (v.Info.Chat == constants.ChatIDBotTest()) {
-			state.HandleMinyanMessage(v)
-		}
+	case *events.Receipt:
+		state.HandleReceipt(v)
 	}
 }
 
@@ -60,13 +81,16 @@ func (state *ProgramState) SetupEventHandler() {
 	state.Client.AddEventHandler(func(evt interface{}) { state.HandleEvent(evt) })
 }
 
-func CreateAndSetupStandardProgramState() (*ProgramState, error) {
+func CreateAndSetupStandardProgramState(cfg *config.Config) (*ProgramState, error) {
 	ctx := context.Background()
 
-	calendarBaseService := util.PanicIfError(calendar.NewService(
+	calendarBaseService, err := calendar.NewService(
 		ctx,
-		option.WithAPIKey(constants.GoogleCalendarAPIKey)),
+		option.WithAPIKey(cfg.GoogleCalendarAPIKey),
 	)
+	if err != nil {
+		return nil, err
+	}
 
 	dbLog := waLog.Stdout("Database", "DEBUG", true)
 	// Make sure you add appropriate DB connector imports, e.g. github.com/mattn/go-sqlite3 for SQLite as we did in this minimal working example
@@ -85,21 +109,57 @@ func CreateAndSetupStandardProgramState() (*ProgramState, error) {
 	client := whatsmeow.NewClient(deviceStore, clientLog)
 
 	scheduler, err := gocron.NewScheduler(
-		gocron.WithLocation(constants.MinyanLocation()),
+		gocron.WithLocation(cfg.Location),
 		gocron.WithLimitConcurrentJobs(1, gocron.LimitModeWait))
 	if err != nil {
 		return nil, err
 	}
 
+	db, err := OpenDatabase(ctx, cfg.DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	calendarEventsService := calendar.NewEventsService(calendarBaseService)
+	googleCalendars := map[string]*GoogleCalendarCache{}
+	for _, site := range cfg.Sites {
+		if site.Calendar.Type != config.CalendarTypeGoogle || googleCalendars[site.Calendar.ID] != nil {
+			continue
+		}
+		googleCalendars[site.Calendar.ID], err = NewGoogleCalendarCache(ctx, calendarEventsService, db, site.Calendar.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	eventSources := map[string]EventSource{}
+	var sourceErrs []error
+	for _, site := range cfg.Sites {
+		eventSources[site.ID], err = NewEventSource(site, googleCalendars, db)
+		if err != nil {
+			sourceErrs = append(sourceErrs, err)
+		}
+	}
+	if len(sourceErrs) != 0 {
+		return nil, errors.Join(sourceErrs...)
+	}
+
+	// Cancelled by Shutdown
+	stateCtx, cancel := context.WithCancel(ctx)
 	programState := &ProgramState{
-		Client:                client,
-		MessageQueue:          make(chan MessageToSend, 1000),
-		CalendarEventsService: calendar.NewEventsService(calendarBaseService),
-		MinyanScheduler:       scheduler,
-		Ctx:                   ctx,
+		Config:          cfg,
+		Client:          client,
+		Outbox:          NewOutbox(db),
+		EventSources:    eventSources,
+		GoogleCalendars: googleCalendars,
+		DB:              db,
+		MinyanScheduler: scheduler,
+		DeviceStore:     deviceStore,
+		Ctx:             stateCtx,
+		cancel:          cancel,
 	}
 
-	programState.SetupMessageQueue()
+	programState.RegisterCommands()
 	programState.SetupEventHandler()
 
 	if client.Store.ID == nil {
@@ -113,11 +173,11 @@ func CreateAndSetupStandardProgramState() (*ProgramState, error) {
 			if evt.Event == "code" {
 				// Render the QR code here
 				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
-				pairingCode, err := client.PairPhone(context.Background(), constants.BotPhoneNumber, true, whatsmeow.PairClientFirefox, "Firefox (Linux)")
+				pairingCode, err := client.PairPhone(context.Background(), cfg.BotPhoneNumber, true, whatsmeow.PairClientFirefox, "Firefox (Linux)")
 				if err != nil {
-					fmt.Println("Error generating pairing code: %v", err)
+					fmt.Printf("Error generating pairing code: %v\n", err)
 				} else {
-					fmt.Println("Generated pairing code: %v", pairingCode)
+					fmt.Printf("Generated pairing code: %v\n", pairingCode)
 				}
 			} else {
 				fmt.Println("Login event:", evt.Event)
@@ -131,7 +191,43 @@ func CreateAndSetupStandardProgramState() (*ProgramState, error) {
 		}
 	}
 
-	programState.RegisterDailyEvents()
+	// Anything left in the outbox from before a restart is sent now
+	programState.SetupMessageQueue()
+
+	err = programState.RegisterDailyEvents()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterCalendarSync()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterChangeAnnouncements()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterScheduledPostEdits()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterPinnedWeeks()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterDeliveryCheck()
+	if err != nil {
+		return nil, err
+	}
+
+	err = programState.RegisterOutboxCleanup()
+	if err != nil {
+		return nil, err
+	}
 
 	programState.MinyanScheduler.Start()
 
@@ -141,20 +237,103 @@ func CreateAndSetupStandardProgramState() (*ProgramState, error) {
 func (state *ProgramState) ReportErrorToMe(err error, errorLocation string) {
 	errorMessage := fmt.Sprintf("Error in %s: '%s'", errorLocation, err.Error())
 	fmt.Println(errorMessage)
-	state.QueueSimpleStringMessage(constants.ChatIDMe(), fmt.Sprintf("```%s```", errorMessage))
+	state.QueueStringMessage(state.Config.ChatIDMe, PriorityAdmin, fmt.Sprintf("```%s```", errorMessage))
+}
+
+// Checks config values with the parsers the bot uses for them, so that mistakes are reported when
+// the config is loaded
+var configChecks = config.Checks{
+	ZmanimRule: func(rule config.ZmanimRule, location *time.Location) error {
+		_, err := parseZmanimRule(rule, location)
+		return err
+	},
+	Times: func(times string, site *config.Site) error {
+		_, err := parseTimeCommand(times, false, site)
+		return err
+	},
 }
 
 func main() {
-	programState := util.PanicIfError(CreateAndSetupStandardProgramState())
+	cfg, err := config.Load(config.Path(), configChecks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	programState, err := CreateAndSetupStandardProgramState(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting the bot:", err)
+		os.Exit(1)
+	}
 
 	time.Sleep(5 * time.Second)
 
-	programState.QueueSimpleStringMessage(constants.ChatIDMe(), "```Bot started```")
+	programState.QueueStringMessage(cfg.ChatIDMe, PriorityAdmin, "```Bot started```")
 
 	// Wait for Ctrl+C
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
-	programState.Client.Disconnect()
+	programState.Shutdown()
+}
+
+// Stops the bot in order: no new events are handled, running jobs finish, and queued messages are
+// sent, for up to Config.ShutdownTimeout. Then everything still running is cancelled (messages
+// which weren't sent stay in the outbox) and the client disconnects.
+func (state *ProgramState) Shutdown() {
+	fmt.Println("Shutting down")
+	state.shuttingDown.Store(true)
+
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), state.Config.ShutdownTimeout)
+	defer cancelDeadline()
+
+	schedulerDone := make(chan error, 1)
+	go func() {
+		schedulerDone <- state.MinyanScheduler.Shutdown()
+	}()
+	select {
+	case err := <-schedulerDone:
+		if err != nil {
+			fmt.Println("Error stopping the scheduler:", err)
+		}
+	case <-deadline.Done():
+		fmt.Println("Gave up waiting for running jobs")
+	}
+
+	if err := state.drainOutbox(deadline); err != nil {
+		fmt.Println("Gave up waiting for queued messages:", err)
+	}
+
+	state.cancel()
+	state.waitForMessageQueue()
+	state.Client.Disconnect()
+
+	if err := state.DB.Close(); err != nil {
+		fmt.Println("Error closing the database:", err)
+	}
+	fmt.Println("Shut down")
+}
+
+// Waits until there are no messages ready to be sent, or ctx is done. Messages waiting to be
+// retried later are left in the outbox.
+func (state *ProgramState) drainOutbox(ctx context.Context) error {
+	for {
+		pending, err := state.Outbox.Pending(ctx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		ready := slices.ContainsFunc(pending, func(msg PendingMessage) bool {
+			return !msg.NextAttemptAt.After(now)
+		})
+		if !ready {
+			return nil
+		}
+
+		if !util.Sleep(ctx, 100*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"nbot-wa/config"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	testChatMe      = types.NewJID("18001231234", types.DefaultUserServer)
+	testChatBotTest = types.NewJID("123456789123456789", types.GroupServer)
+	testChatGroup   = types.NewJID("987654321987654321", types.GroupServer)
+	testChatUser    = types.NewJID("18005550100", types.DefaultUserServer)
+)
+
+// Sets up a ProgramState with one site, whose events come from source, and a RecordingMessenger
+// in place of the WhatsApp client
+func newTestProgramState(t *testing.T, source EventSource) (*ProgramState, *RecordingMessenger) {
+	t.Helper()
+
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabase(context.Background(), t.TempDir()+"/nbot.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	site := &config.Site{
+		ID:       "beis_midrash",
+		Name:     "Beis Midrash",
+		Calendar: config.Calendar{Type: config.CalendarTypeLocal},
+		Location: location,
+		Groups:   []types.JID{testChatGroup},
+	}
+
+	cfg := &config.Config{
+		MaintainerName: "Maintainer",
+		BotPhoneNumber: "18009999999",
+		Location:       location,
+		ChatIDMe:       testChatMe,
+		ChatIDBotTest:  testChatBotTest,
+		Sending: config.Sending{
+			MaxMessageLength:  4000,
+			MaxMessageParts:   4,
+			MessagesPerMinute: 6000,
+			Burst:             100,
+		},
+		Sites: []*config.Site{site},
+	}
+
+	messenger := NewRecordingMessenger()
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &ProgramState{
+		Config:       cfg,
+		Client:       messenger,
+		Outbox:       NewOutbox(db),
+		EventSources: map[string]EventSource{site.ID: source},
+		DB:           db,
+		DeviceStore:  &store.Device{},
+		Ctx:          ctx,
+		cancel:       cancel,
+	}
+	t.Cleanup(func() {
+		cancel()
+		state.waitForMessageQueue()
+	})
+
+	state.RegisterCommands()
+	state.SetupEventHandler()
+	state.SetupMessageQueue()
+
+	return state, messenger
+}
+
+var testMessageCount = 0
+
+func testMessage(chat types.JID, sender types.JID, text string) *events.Message {
+	testMessageCount++
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    chat,
+				Sender:  sender,
+				IsGroup: chat.Server == types.GroupServer,
+			},
+			ID:        types.MessageID(fmt.Sprintf("TEST%d", testMessageCount)),
+			Timestamp: time.Now(),
+		},
+		Message: &waE2E.Message{Conversation: proto.String(text)},
+	}
+}
+
+// Feeds v to the bot and returns the text of the single reply, checking that it quotes v
+func replyTo(t *testing.T, messenger *RecordingMessenger, v *events.Message) string {
+	t.Helper()
+
+	before := len(messenger.Messages())
+	messenger.Dispatch(v)
+
+	messages, ok := messenger.WaitForMessages(before+1, 5*time.Second)
+	if !ok {
+		t.Fatalf("No reply to %q", v.Message.GetConversation())
+	}
+	// Give any further parts time to be sent
+	time.Sleep(100 * time.Millisecond)
+	if messages = messenger.Messages(); len(messages) != before+1 {
+		t.Fatalf("Expected one reply to %q, got %d", v.Message.GetConversation(), len(messages)-before)
+	}
+
+	reply := messages[before]
+	if reply.Chat != v.Info.Chat {
+		t.Errorf("Reply sent to %v instead of %v", reply.Chat, v.Info.Chat)
+	}
+	extended := reply.Message.GetExtendedTextMessage()
+	if extended.GetContextInfo().GetStanzaID() != v.Info.ID {
+		t.Errorf("Reply to %q doesn't quote it: %v", v.Message.GetConversation(), reply.Message)
+	}
+	return extended.GetText()
+}
+
+func TestPing(t *testing.T) {
+	_, messenger := newTestProgramState(t, NewMemoryEventSource())
+
+	if reply := replyTo(t, messenger, testMessage(testChatBotTest, testChatUser, "ping")); reply != "pong" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestPingNeedsToBeAlone(t *testing.T) {
+	_, messenger := newTestProgramState(t, NewMemoryEventSource())
+
+	messenger.Dispatch(testMessage(testChatBotTest, testChatUser, "ping me later"))
+	if messages, ok := messenger.WaitForMessages(1, 200*time.Millisecond); ok {
+		t.Errorf("Unexpected reply %v", messages[0].Message)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	location, _ := time.LoadLocation("America/New_York")
+	source := NewMemoryEventSource(
+		ParsedEvent{Name: "Shacharis", DateTime: time.Date(2030, 3, 14, 7, 0, 0, 0, location)},
+		ParsedEvent{Name: "Mincha", DateTime: time.Date(2030, 3, 14, 13, 45, 0, 0, location)},
+		ParsedEvent{Name: "Shacharis", DateTime: time.Date(2030, 3, 15, 7, 0, 0, 0, location)},
+	)
+	_, messenger := newTestProgramState(t, source)
+
+	reply := replyTo(t, messenger, testMessage(testChatGroup, testChatUser, "!times 3/14/2030"))
+	expected := "*Minyan times for date:*\n" +
+		"Thursday, March 14th 2030\n" +
+		"- *Shacharis*: 7:00\u202fᴀᴍ\n" +
+		"- *Mincha*: 1:45\u202fᴘᴍ"
+	if reply != expected {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	_, messenger := newTestProgramState(t, NewMemoryEventSource())
+
+	reply := replyTo(t, messenger, testMessage(testChatUser, testChatUser, "!help"))
+	expected := strings.Join([]string{
+		"*Usage:*",
+		"",
+		"`!times` or `!times upcoming`",
+		"- Displays upcoming minyan times for today and tomorrow",
+		"",
+		"`!times week`",
+		"- Displays upcoming minyan times for the next 7 days",
+		"",
+		"`!times DATE`",
+		"- Displays minyan times for `DATE`",
+		"",
+		"`!times week of DATE`",
+		"- Displays minyan times for the week of `DATE`",
+		"",
+		"`!times DATE to DATE`",
+		"- Displays minyan times between the first `DATE` and the second `DATE`",
+		"",
+		"`!times` can also be written `!time`",
+		"",
+		"Outside of a minyan's group, put the name of the minyan right after `!times`, e.g. `!times beis midrash week`",
+		"",
+		"The `DATE` can be in any of the following formats (capitalization doesn't matter):",
+		"- `today` or `tomorrow`",
+		"- A day of the week like `Mon`, `Tuesday`, `Shabbat`, etc.",
+		"- A date in the format `M[M]/D[D][/[YY]YY]`, e.g. `1/21`, `08/15/25`, `11/07/2026`",
+		"- A date in the format `Month DD[th][[,] YYYY]`, e.g. `Jan 21st`, `August 15 2025`, `November 7th, 2000`",
+		"",
+		"*Gabbai commands* (for minyanim whose schedule is kept by the bot):",
+		"",
+		"`!addtime NAME DAYS TIME`",
+		"- Adds a minyan, e.g. `!addtime mincha weekdays 1:45pm`. `DAYS` can be `daily`, `weekdays` (Sun-Fri), a day like `sun`, a range like `sun-thu`, a list like `mon,wed`, or a `DATE` for a one-time minyan",
+		"",
+		"`!removetime NUMBER`",
+		"- Removes the minyan with the number shown by `!listtimes`",
+		"",
+		"`!listtimes`",
+		"- Lists the schedule",
+	}, "\n")
+	if reply != expected {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestMaintainerCommandsNeedMaintainer(t *testing.T) {
+	_, messenger := newTestProgramState(t, NewMemoryEventSource())
+
+	reply := replyTo(t, messenger, testMessage(testChatBotTest, testChatUser, "!sync"))
+	if expected := "```Only Maintainer can use !sync```"; reply != expected {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestMentionAsksTimes(t *testing.T) {
+	location, _ := time.LoadLocation("America/New_York")
+	source := NewMemoryEventSource(
+		ParsedEvent{Name: "Mincha", DateTime: time.Date(2030, 3, 14, 13, 45, 0, 0, location)},
+	)
+	state, messenger := newTestProgramState(t, source)
+
+	bot := state.botJIDs()[0]
+	v := testMessage(testChatGroup, testChatUser, "")
+	v.Message = &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+		Text:        proto.String("@" + bot.User + " when is mincha 3/14/2030?"),
+		ContextInfo: &waE2E.ContextInfo{MentionedJID: []string{bot.String()}},
+	}}
+
+	reply := replyTo(t, messenger, v)
+	expected := "*Minyan times for date:*\n" +
+		"Thursday, March 14th 2030\n" +
+		"- *Mincha*: 1:45\u202fᴘᴍ"
+	if reply != expected {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestMentionByLIDAfterPairing(t *testing.T) {
+	location, _ := time.LoadLocation("America/New_York")
+	source := NewMemoryEventSource(
+		ParsedEvent{Name: "Mincha", DateTime: time.Date(2030, 3, 14, 13, 45, 0, 0, location)},
+	)
+	state, messenger := newTestProgramState(t, source)
+
+	// Pairing sets the LID after the event handler is set up
+	lid := types.NewJID("123456789012345", types.HiddenUserServer)
+	state.DeviceStore.LID = lid
+
+	v := testMessage(testChatGroup, testChatUser, "")
+	v.Message = &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+		Text:        proto.String("@" + lid.User + " times 3/14/2030"),
+		ContextInfo: &waE2E.ContextInfo{MentionedJID: []string{lid.String()}},
+	}}
+
+	reply := replyTo(t, messenger, v)
+	expected := "*Minyan times for date:*\n" +
+		"Thursday, March 14th 2030\n" +
+		"- *Mincha*: 1:45\u202fᴘᴍ"
+	if reply != expected {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestTimesExplainsMistakes(t *testing.T) {
+	_, messenger := newTestProgramState(t, NewMemoryEventSource())
+
+	for text, expected := range map[string]string{
+		"!times 2/30/2030": "I couldn't understand `2/30/2030` — February has 28 days",
+		"!times tomorow":   "I couldn't understand `tomorow` — did you mean `tomorrow`?",
+	} {
+		if reply := replyTo(t, messenger, testMessage(testChatGroup, testChatUser, text)); reply != expected {
+			t.Errorf("Unexpected reply to %q: %q", text, reply)
+		}
+	}
+}
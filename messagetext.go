@@ -0,0 +1,70 @@
+package main
+
+import (
+	"go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+// Returns the text that was typed in a message, whichever way it was sent: plain text, extended
+// text (replies, link previews and WhatsApp Web), or the caption of an image, video or document.
+// Ephemeral, view-once and similar wrappers are looked through. Returns "" for messages without
+// text.
+func MessageText(message *waE2E.Message) string {
+	message = unwrapMessage(message)
+
+	switch {
+	case message.GetConversation() != "":
+		return message.GetConversation()
+	case message.GetExtendedTextMessage() != nil:
+		return message.GetExtendedTextMessage().GetText()
+	case message.GetImageMessage() != nil:
+		return message.GetImageMessage().GetCaption()
+	case message.GetVideoMessage() != nil:
+		return message.GetVideoMessage().GetCaption()
+	case message.GetDocumentMessage() != nil:
+		return message.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+// Returns the context of a message with text, which has the users mentioned in it and the message
+// it replies to, or nil
+func messageContextInfo(message *waE2E.Message) *waE2E.ContextInfo {
+	message = unwrapMessage(message)
+
+	switch {
+	case message.GetExtendedTextMessage() != nil:
+		return message.GetExtendedTextMessage().GetContextInfo()
+	case message.GetImageMessage() != nil:
+		return message.GetImageMessage().GetContextInfo()
+	case message.GetVideoMessage() != nil:
+		return message.GetVideoMessage().GetContextInfo()
+	case message.GetDocumentMessage() != nil:
+		return message.GetDocumentMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// Returns the message inside any wrappers. whatsmeow already unwraps received messages once, but
+// the wrappers can be nested.
+func unwrapMessage(message *waE2E.Message) *waE2E.Message {
+	for {
+		var inner *waE2E.Message
+		switch {
+		case message.GetDeviceSentMessage().GetMessage() != nil:
+			inner = message.GetDeviceSentMessage().GetMessage()
+		case message.GetEphemeralMessage().GetMessage() != nil:
+			inner = message.GetEphemeralMessage().GetMessage()
+		case message.GetViewOnceMessage().GetMessage() != nil:
+			inner = message.GetViewOnceMessage().GetMessage()
+		case message.GetViewOnceMessageV2().GetMessage() != nil:
+			inner = message.GetViewOnceMessageV2().GetMessage()
+		case message.GetViewOnceMessageV2Extension().GetMessage() != nil:
+			inner = message.GetViewOnceMessageV2Extension().GetMessage()
+		case message.GetDocumentWithCaptionMessage().GetMessage() != nil:
+			inner = message.GetDocumentWithCaptionMessage().GetMessage()
+		default:
+			return message
+		}
+		message = inner
+	}
+}
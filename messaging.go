@@ -2,52 +2,498 @@ package main
 
 import (
 	"fmt"
-	"nbot-wa/util"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"nbot-wa/config"
+	"nbot-wa/util"
 
+	"github.com/go-co-op/gocron/v2"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCommon"
 	"go.mau.fi/whatsmeow/proto/waE2E"
 	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
 	"google.golang.org/protobuf/proto"
 )
 
+type MessagePriority int
+
+// Higher priority messages are sent first, across all chats and within a chat, with priorities
+// raised for the time waited (see effectivePriority)
+const (
+	// Scheduled posts and announcements to groups
+	PriorityBroadcast MessagePriority = iota
+	// Replies to commands
+	PriorityInteractive
+	// Errors and alerts for the maintainer
+	PriorityAdmin
+)
+
+// Messages go up a priority for every priorityAgingInterval they wait, so that lower priority
+// messages are eventually sent even when there are always higher priority ones
+const priorityAgingInterval = 2 * time.Minute
+
 type MessageToSend struct {
 	Chat    types.JID
 	Message *waE2E.Message
+
+	OutboxID int64
+	ID       types.MessageID
+	// How many times sending has failed so far
+	Attempts int
+	// How many times the message had been changed when it was loaded
+	Version int
 }
 
-func (state *ProgramState) QueueMessage(chat types.JID, message *waE2E.Message) {
+// Returns the message's outbox ID, or 0 if it couldn't be queued
+func (state *ProgramState) QueueMessage(chat types.JID, message *waE2E.Message, priority MessagePriority) int64 {
 	fmt.Printf("Message queued in chat '%v' {%v}\n", chat.String(), message.String())
-	state.MessageQueue <- MessageToSend{
-		Chat:    chat,
-		Message: message,
+	outboxID, err := state.Outbox.Enqueue(state.Ctx, chat, message, priority)
+	if err != nil {
+		// Reporting this would need the outbox too
+		fmt.Printf("Error queueing message in chat '%v': %v\n", chat.String(), err)
 	}
+	return outboxID
 }
 
-func (state *ProgramState) QueueSimpleStringMessage(chat types.JID, message string) {
-	if len(message) > 10000 {
-		errorMessage := "\n\n_...trunacated to 10,000 characters_"
-		message = message[:10000-len(errorMessage)]
+// Queues a reply to v, quoting it so that it's clear which request the reply is for. The sections
+// are joined into one message, or split between sections into several if it is too long; only the
+// first part quotes v. If v is an edited command, the replies to it are edited instead if possible.
+func (state *ProgramState) QueueReply(v *events.Message, sections ...string) {
+	messages := []*waE2E.Message{}
+	for i, part := range state.splitMessage(sections) {
+		if i == 0 {
+			messages = append(messages, replyMessage(part, v))
+		} else {
+			messages = append(messages, stringMessage(part))
+		}
+	}
+
+	if v.IsEdit && state.editReplies(v, messages) {
+		return
+	}
+
+	for i, message := range messages {
+		if outboxID := state.QueueMessage(v.Info.Chat, message, PriorityInteractive); outboxID != 0 {
+			state.rememberReply(v, i, outboxID)
+		}
 	}
-	state.QueueMessage(chat, &waE2E.Message{
+}
+
+func (state *ProgramState) QueueStringMessage(chat types.JID, priority MessagePriority, sections ...string) {
+	for _, part := range state.splitMessage(sections) {
+		state.QueueMessage(chat, stringMessage(part), priority)
+	}
+}
+
+// Queues a message unless one was already queued with the same key, e.g. for a day's scheduled
+// post, so that it is sent exactly once even if the job runs twice. Returns true if the first part
+// was queued now.
+func (state *ProgramState) QueueStringMessageOnce(key string, chat types.JID, priority MessagePriority, sections ...string) bool {
+	queuedFirst := false
+	for i, part := range state.splitMessage(sections) {
+		partKey := messagePartKey(key, i)
+		queued, err := state.Outbox.EnqueueOnce(state.Ctx, partKey, chat, stringMessage(part), priority)
+		if err != nil {
+			fmt.Printf("Error queueing message in chat '%v': %v\n", chat.String(), err)
+		} else if queued {
+			fmt.Printf("Message queued in chat '%v' (%s)\n", chat.String(), partKey)
+		} else {
+			fmt.Printf("Message already queued in chat '%v' (%s)\n", chat.String(), partKey)
+		}
+		if i == 0 {
+			queuedFirst = queued
+		}
+	}
+	return queuedFirst
+}
+
+// The key of part i (from 0) of a message queued once with key
+func messagePartKey(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s|%d", key, i+1)
+}
+
+func stringMessage(message string) *waE2E.Message {
+	return &waE2E.Message{
 		Conversation: proto.String(message),
-	})
+	}
+}
+
+// A text message quoting v
+func replyMessage(message string, v *events.Message) *waE2E.Message {
+	return &waE2E.Message{
+		ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text: proto.String(message),
+			ContextInfo: &waE2E.ContextInfo{
+				StanzaID:      proto.String(v.Info.ID),
+				Participant:   proto.String(v.Info.Sender.ToNonAD().String()),
+				QuotedMessage: v.Message,
+			},
+		},
+	}
+}
+
+// An edit of the message with the given ID, which the bot sent to chat. This is what
+// whatsmeow.Client.BuildEdit does, without needing the client.
+func editMessage(chat types.JID, id types.MessageID, newContent *waE2E.Message) *waE2E.Message {
+	return &waE2E.Message{
+		EditedMessage: &waE2E.FutureProofMessage{
+			Message: &waE2E.Message{
+				ProtocolMessage: &waE2E.ProtocolMessage{
+					Key: &waCommon.MessageKey{
+						FromMe:    proto.Bool(true),
+						ID:        proto.String(id),
+						RemoteJID: proto.String(chat.String()),
+					},
+					Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+					EditedMessage: newContent,
+					TimestampMS:   proto.Int64(time.Now().UnixMilli()),
+				},
+			},
+		},
+	}
+}
+
+// How long pinned messages stay pinned. WhatsApp allows 24 hours, 7 days or 30 days.
+const pinDuration = 7 * 24 * time.Hour
+
+// Pins or unpins the message with the given ID, which the bot sent to chat
+func pinMessage(chat types.JID, id types.MessageID, pin bool) *waE2E.Message {
+	pinType := waE2E.PinInChatMessage_PIN_FOR_ALL
+	if !pin {
+		pinType = waE2E.PinInChatMessage_UNPIN_FOR_ALL
+	}
+
+	return &waE2E.Message{
+		PinInChatMessage: &waE2E.PinInChatMessage{
+			Key: &waCommon.MessageKey{
+				FromMe:    proto.Bool(true),
+				ID:        proto.String(id),
+				RemoteJID: proto.String(chat.String()),
+			},
+			Type:              pinType.Enum(),
+			SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+		},
+		MessageContextInfo: &waE2E.MessageContextInfo{
+			MessageAddOnDurationInSecs: proto.Uint32(uint32(pinDuration.Seconds())),
+		},
+	}
+}
+
+// Added to the last part of a message which has more than the maximum number of parts
+const messageCutShortNote = "\n\n_...cut short, ask for fewer days to see the rest_"
+
+// Room left at the end of every message for a footer of up to this many characters, so that one
+// can be added when the message is edited (like scheduledPostUpdatedMarker) without changing how
+// it is split
+const messageFooterRoom = 20
+
+func (state *ProgramState) splitMessage(sections []string) []string {
+	return splitMessage(sections, state.Config.Sending.MaxMessageLength, state.Config.Sending.MaxMessageParts, "")
+}
+
+// Joins sections (e.g. the days of a schedule) into parts of at most maxLength characters, only
+// splitting inside a section if it doesn't fit in a part by itself. When there is more than one
+// part, each is marked "(1/3)" etc. Parts after the first maxParts are dropped. The footer, of at
+// most messageFooterRoom characters, is added to the last part; it doesn't change where the
+// message is split.
+func splitMessage(sections []string, maxLength int, maxParts int, footer string) []string {
+	// Leave room for the marker, the note and the footer
+	limit := maxLength - len("\n\n(99/99)") - utf8.RuneCountInString(messageCutShortNote) - messageFooterRoom
+
+	parts := []string{}
+	var builder strings.Builder
+	length := 0
+	for _, section := range sections {
+		for _, piece := range splitSection(section, limit) {
+			pieceLength := utf8.RuneCountInString(piece)
+			if length > 0 && length+pieceLength > limit {
+				parts = append(parts, builder.String())
+				builder.Reset()
+				length = 0
+			}
+			if length == 0 {
+				// Sections start with the blank line that separates them from the previous one
+				piece = strings.TrimLeft(piece, "\n")
+			}
+			builder.WriteString(piece)
+			length += utf8.RuneCountInString(piece)
+		}
+	}
+	if length > 0 || len(parts) == 0 {
+		parts = append(parts, builder.String())
+	}
+
+	if len(parts) > maxParts {
+		parts = parts[:maxParts]
+		parts[len(parts)-1] += messageCutShortNote
+	}
+	parts[len(parts)-1] += footer
+	if len(parts) > 1 {
+		for i := range parts {
+			parts[i] += fmt.Sprintf("\n\n(%d/%d)", i+1, len(parts))
+		}
+	}
+
+	return parts
+}
+
+// Splits a section which is longer than limit characters between lines, and lines which are still
+// too long between characters
+func splitSection(section string, limit int) []string {
+	if utf8.RuneCountInString(section) <= limit {
+		return []string{section}
+	}
+
+	pieces := []string{}
+	for i, line := range strings.Split(section, "\n") {
+		if i > 0 {
+			line = "\n" + line
+		}
+
+		runes := []rune(line)
+		for len(runes) > limit {
+			pieces = append(pieces, string(runes[:limit]))
+			runes = runes[limit:]
+		}
+		pieces = append(pieces, string(runes))
+	}
+	return pieces
+}
+
+// Where a chat's last message was sent, for pacing the next one
+type chatLane struct {
+	inFlight   bool
+	nextSendAt time.Time
+	lastServed time.Time
 }
 
+// Sends the messages in the outbox. Each chat is a lane which sends its messages in order, one at
+// a time and spaced out. Chats which are ready take turns (least recently served first), within a
+// rate limit across all chats, so a long backlog in one chat doesn't hold up the others.
 func (state *ProgramState) SetupMessageQueue() {
+	sending := state.Config.Sending
+	bucket := util.NewTokenBucket(sending.MessagesPerMinute/60, sending.Burst)
+	lanes := map[string]*chatLane{}
+	finished := make(chan string)
+	state.queueStopped = make(chan struct{})
+
 	go func() {
-		for msg := range state.MessageQueue {
-			delayTime := util.AsMilliseconds(util.RandBetween(500, 1000))
-			time.Sleep(delayTime)
+		// Sends are only started from here, so once this returns no more are added to state.sends
+		defer close(state.queueStopped)
+
+		for {
+			next, wait, err := state.nextFromOutbox(lanes, bucket)
+			if err != nil {
+				if state.Ctx.Err() != nil {
+					return
+				}
+				fmt.Println("Error reading the outbox:", err)
+				wait = outboxMinBackoff
+			}
 
-			typeTime := util.AsMilliseconds(util.RandBetween(1000, 2000))
-			state.Client.SendChatPresence(state.Ctx, msg.Chat, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-			time.Sleep(typeTime)
+			if next != nil {
+				lane := lanes[next.Chat.String()]
+				lane.inFlight = true
+				lane.lastServed = time.Now()
 
-			state.Client.SendMessage(state.Ctx, msg.Chat, msg.Message)
+				state.sends.Add(1)
+				go func() {
+					defer state.sends.Done()
+					state.sendInLane(next)
+					select {
+					case finished <- next.Chat.String():
+					case <-state.Ctx.Done():
+					}
+				}()
+				continue
+			}
 
-			// We won't process any more messages for at least 4 seconds
-			rateLimitTime := util.AsMilliseconds(util.RandBetween(4000, 5000))
-			time.Sleep(rateLimitTime)
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+
+			select {
+			case <-state.Ctx.Done():
+				return
+			case <-state.Outbox.Added():
+			case <-timer:
+			case chat := <-finished:
+				lane := lanes[chat]
+				lane.inFlight = false
+				lane.nextSendAt = time.Now().Add(state.chatPacing(chat).Spacing.Random())
+			}
 		}
 	}()
 }
+
+// Deletes old messages from the outbox every outboxCleanupInterval
+func (state *ProgramState) RegisterOutboxCleanup() error {
+	_, err := state.MinyanScheduler.NewJob(
+		gocron.DurationJob(outboxCleanupInterval),
+		gocron.NewTask(func() {
+			if err := state.Outbox.CleanUp(state.Ctx); err != nil {
+				state.ReportErrorToMe(err, "CleanUp")
+			}
+		}),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	return err
+}
+
+// Waits for the message queue to stop and the messages being sent to finish, once Ctx is cancelled
+func (state *ProgramState) waitForMessageQueue() {
+	if state.queueStopped != nil {
+		<-state.queueStopped
+	}
+	state.sends.Wait()
+}
+
+// Picks the next message to send, or returns how long to wait until one may be ready (0 if there
+// is nothing to send)
+func (state *ProgramState) nextFromOutbox(lanes map[string]*chatLane, bucket *util.TokenBucket) (*MessageToSend, time.Duration, error) {
+	pending, err := state.Outbox.Pending(state.Ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	waitUntil := func(t time.Time) {
+		if d := t.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+
+	// Only the most urgent message in each chat can be sent: the one with the highest priority,
+	// raised for the time waited, and then the one queued first
+	candidates := []*PendingMessage{}
+	candidateIndex := map[string]int{}
+	for i := range pending {
+		msg := &pending[i]
+		j, ok := candidateIndex[msg.Chat]
+		if !ok {
+			candidateIndex[msg.Chat] = len(candidates)
+			candidates = append(candidates, msg)
+		} else if effectivePriority(msg, now) > effectivePriority(candidates[j], now) {
+			candidates[j] = msg
+		}
+	}
+
+	var best *PendingMessage
+	for _, msg := range candidates {
+		lane := lanes[msg.Chat]
+		if lane == nil {
+			lane = &chatLane{}
+			lanes[msg.Chat] = lane
+		}
+		if lane.inFlight {
+			continue
+		}
+
+		readyAt := msg.NextAttemptAt
+		if lane.nextSendAt.After(readyAt) {
+			readyAt = lane.nextSendAt
+		}
+		if readyAt.After(now) {
+			waitUntil(readyAt)
+			continue
+		}
+
+		if best == nil || sendsBefore(msg, best, lanes, now) {
+			best = msg
+		}
+	}
+
+	if best == nil {
+		return nil, wait, nil
+	}
+
+	if ok, tokenWait := bucket.TryTake(); !ok {
+		waitUntil(now.Add(tokenWait))
+		return nil, wait, nil
+	}
+
+	msg, err := state.Outbox.Load(state.Ctx, best.OutboxID)
+	if err != nil || msg == nil {
+		// Try again straight away, without the message if it was dropped
+		return nil, time.Millisecond, err
+	}
+	return msg, 0, nil
+}
+
+// Whether a should be sent before b: by priority (raised for the time waited), then to the chat
+// which was served least recently
+func sendsBefore(a *PendingMessage, b *PendingMessage, lanes map[string]*chatLane, now time.Time) bool {
+	priorityA := effectivePriority(a, now)
+	priorityB := effectivePriority(b, now)
+	if priorityA != priorityB {
+		return priorityA > priorityB
+	}
+
+	return lanes[a.Chat].lastServed.Before(lanes[b.Chat].lastServed)
+}
+
+func effectivePriority(msg *PendingMessage, now time.Time) MessagePriority {
+	return msg.Priority + MessagePriority(now.Sub(msg.CreatedAt)/priorityAgingInterval)
+}
+
+// Sends a message after the delays for its kind of chat
+func (state *ProgramState) sendInLane(msg *MessageToSend) {
+	pacing := state.chatPacing(msg.Chat.String())
+
+	// On shutdown the message stays in the outbox, to be sent after the next start
+	if !util.Sleep(state.Ctx, pacing.Delay.Random()) {
+		return
+	}
+
+	if typing := pacing.Typing.Random(); typing > 0 {
+		state.Client.SendChatPresence(state.Ctx, msg.Chat, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+		if !util.Sleep(state.Ctx, typing) {
+			return
+		}
+	}
+
+	state.sendFromOutbox(msg)
+}
+
+func (state *ProgramState) chatPacing(chat string) config.ChatPacing {
+	jid, _ := types.ParseJID(chat)
+	switch {
+	case jid == state.Config.ChatIDMe || jid == state.Config.ChatIDBotTest:
+		return state.Config.Sending.Admin
+	case jid.Server == types.GroupServer:
+		return state.Config.Sending.Group
+	default:
+		return state.Config.Sending.Direct
+	}
+}
+
+// Sends a message and records the result in the outbox
+func (state *ProgramState) sendFromOutbox(msg *MessageToSend) {
+	// SendMessage returns once the server has acknowledged the message
+	response, sendErr := state.Client.SendMessage(state.Ctx, msg.Chat, msg.Message, whatsmeow.SendRequestExtra{ID: msg.ID})
+	if sendErr == nil {
+		if err := state.Outbox.MarkSent(state.Ctx, msg, response); err != nil {
+			fmt.Println("Error updating the outbox:", err)
+		}
+		return
+	}
+
+	fmt.Printf("Error sending message in chat '%v' (attempt %d): %v\n", msg.Chat.String(), msg.Attempts+1, sendErr)
+	gaveUp, err := state.Outbox.MarkFailed(state.Ctx, msg, sendErr)
+	if err != nil {
+		fmt.Println("Error updating the outbox:", err)
+	}
+
+	// Don't report failures to send reports, which would just fail again
+	if gaveUp && msg.Chat != state.Config.ChatIDMe {
+		state.ReportErrorToMe(fmt.Errorf("gave up sending a message to %v after %d attempts: %w", msg.Chat, msg.Attempts, sendErr), "sendFromOutbox")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"nbot-wa/util"
+)
+
+// Sets up a ProgramState with only an outbox, for testing the message queue without running it
+func newTestOutboxState(t *testing.T) *ProgramState {
+	t.Helper()
+
+	db, err := OpenDatabase(context.Background(), t.TempDir()+"/nbot.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &ProgramState{Outbox: NewOutbox(db), DB: db, Ctx: context.Background()}
+}
+
+func TestAgedBroadcastSendsBeforeNewerReplies(t *testing.T) {
+	state := newTestOutboxState(t)
+
+	broadcast, err := state.Outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("Minyan times"), PriorityBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.DB.Exec(`UPDATE outbox SET created_at = ? WHERE id = ?`, time.Now().Add(-time.Hour).Unix(), broadcast); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := state.Outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("pong"), PriorityInteractive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next, _, err := state.nextFromOutbox(map[string]*chatLane{}, util.NewTokenBucket(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || next.OutboxID != broadcast {
+		t.Errorf("Expected the broadcast queued an hour ago to be sent first, got %v", next)
+	}
+}
+
+func TestNewerReplySendsBeforeBroadcast(t *testing.T) {
+	state := newTestOutboxState(t)
+
+	if _, err := state.Outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("Minyan times"), PriorityBroadcast); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := state.Outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("pong"), PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, _, err := state.nextFromOutbox(map[string]*chatLane{}, util.NewTokenBucket(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || next.OutboxID != reply {
+		t.Errorf("Expected the reply to be sent first, got %v", next)
+	}
+}
+
+func TestFooterDoesntChangeSplit(t *testing.T) {
+	// The last part is as full as it can be without the footer
+	limit := 200 - len("\n\n(99/99)") - utf8.RuneCountInString(messageCutShortNote) - messageFooterRoom
+	sections := []string{strings.Repeat("a", limit), "\n\n" + strings.Repeat("b", limit-2)}
+
+	posted := splitMessage(sections, 200, 4, "")
+	edited := splitMessage(sections, 200, 4, scheduledPostUpdatedMarker)
+	if len(posted) != 2 || len(edited) != len(posted) {
+		t.Fatalf("Expected 2 parts both times, got %d and %d", len(posted), len(edited))
+	}
+	if expected := strings.Repeat("b", limit-2) + scheduledPostUpdatedMarker + "\n\n(2/2)"; edited[1] != expected {
+		t.Errorf("Unexpected last part %q", edited[1])
+	}
+	if length := utf8.RuneCountInString(edited[1]); length > 200 {
+		t.Errorf("Last part is %d characters long", length)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	const maxLength = 200
+	// The characters a part can hold, besides its number, the cut short note and a footer
+	limit := maxLength - len("\n\n(99/99)") - utf8.RuneCountInString(messageCutShortNote) - messageFooterRoom
+	a := func(n int) string { return strings.Repeat("a", n) }
+	b := func(n int) string { return strings.Repeat("b", n) }
+
+	tests := []struct {
+		name     string
+		sections []string
+		maxParts int
+		expected []string
+	}{
+		{
+			name:     "fits in one part",
+			sections: []string{"*Sunday*\n- Mincha: 1:45", "\n\n*Monday*\n- Mincha: 1:45"},
+			maxParts: 4,
+			expected: []string{"*Sunday*\n- Mincha: 1:45\n\n*Monday*\n- Mincha: 1:45"},
+		},
+		{
+			name:     "split between days",
+			sections: []string{"*Sunday*\n" + a(limit-40), "\n\n*Monday*\n" + b(limit-40)},
+			maxParts: 4,
+			expected: []string{
+				"*Sunday*\n" + a(limit-40) + "\n\n(1/2)",
+				"*Monday*\n" + b(limit-40) + "\n\n(2/2)",
+			},
+		},
+		{
+			name:     "day longer than a part, split between lines",
+			sections: []string{"*Sunday*\n" + a(limit-20) + "\n" + b(30)},
+			maxParts: 4,
+			expected: []string{
+				"*Sunday*\n" + a(limit-20) + "\n\n(1/2)",
+				b(30) + "\n\n(2/2)",
+			},
+		},
+		{
+			name:     "multi-byte character at the limit",
+			sections: []string{a(limit-1) + "ש" + "🕍"},
+			maxParts: 4,
+			expected: []string{
+				a(limit-1) + "ש" + "\n\n(1/2)",
+				"🕍" + "\n\n(2/2)",
+			},
+		},
+		{
+			name:     "cut short after the maximum number of parts",
+			sections: []string{a(limit - 50), "\n\n" + b(limit-50), "\n\n" + a(limit-50)},
+			maxParts: 2,
+			expected: []string{
+				a(limit-50) + "\n\n(1/2)",
+				b(limit-50) + messageCutShortNote + "\n\n(2/2)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		parts := splitMessage(test.sections, maxLength, test.maxParts, "")
+		if !slices.Equal(parts, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, parts)
+		}
+		for _, part := range parts {
+			if !utf8.ValidString(part) || utf8.RuneCountInString(part) > maxLength {
+				t.Errorf("%s: invalid part %q", test.name, part)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The parts of the WhatsApp client that the bot uses once it is logged in, so that they can be
+// replaced with a RecordingMessenger in tests
+type Messenger interface {
+	SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	SendChatPresence(ctx context.Context, jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error
+	MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat types.JID, sender types.JID, receiptTypeExtra ...types.ReceiptType) error
+	AddEventHandler(handler whatsmeow.EventHandler) uint32
+	Disconnect()
+}
+
+var _ Messenger = (*whatsmeow.Client)(nil)
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+)
+
+type RecordedMessage struct {
+	Chat    types.JID
+	Message *waE2E.Message
+	ID      types.MessageID
+}
+
+type RecordedPresence struct {
+	Chat  types.JID
+	State types.ChatPresence
+}
+
+type RecordedRead struct {
+	Chat types.JID
+	IDs  []types.MessageID
+}
+
+// A Messenger which doesn't connect to WhatsApp. It records everything sent through it, and
+// Dispatch feeds events to the handlers as if they had been received.
+type RecordingMessenger struct {
+	mutex     sync.Mutex
+	handlers  []whatsmeow.EventHandler
+	messages  []RecordedMessage
+	presences []RecordedPresence
+	reads     []RecordedRead
+	nextID    int
+}
+
+func NewRecordingMessenger() *RecordingMessenger {
+	return &RecordingMessenger{}
+}
+
+func (messenger *RecordingMessenger) SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+
+	messenger.nextID++
+	id := types.MessageID(fmt.Sprintf("RECORDED%d", messenger.nextID))
+	if len(extra) != 0 && extra[0].ID != "" {
+		id = extra[0].ID
+	}
+
+	messenger.messages = append(messenger.messages, RecordedMessage{
+		Chat:    to,
+		Message: message,
+		ID:      id,
+	})
+
+	return whatsmeow.SendResponse{
+		ID:        id,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+func (messenger *RecordingMessenger) SendChatPresence(ctx context.Context, jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+
+	messenger.presences = append(messenger.presences, RecordedPresence{
+		Chat:  jid,
+		State: state,
+	})
+	return nil
+}
+
+func (messenger *RecordingMessenger) MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat types.JID, sender types.JID, receiptTypeExtra ...types.ReceiptType) error {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+
+	messenger.reads = append(messenger.reads, RecordedRead{
+		Chat: chat,
+		IDs:  slices.Clone(ids),
+	})
+	return nil
+}
+
+func (messenger *RecordingMessenger) AddEventHandler(handler whatsmeow.EventHandler) uint32 {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+
+	messenger.handlers = append(messenger.handlers, handler)
+	return uint32(len(messenger.handlers))
+}
+
+func (messenger *RecordingMessenger) Disconnect() {}
+
+// Calls the event handlers with evt, as the client does when an event is received
+func (messenger *RecordingMessenger) Dispatch(evt any) {
+	messenger.mutex.Lock()
+	handlers := slices.Clone(messenger.handlers)
+	messenger.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(evt)
+	}
+}
+
+func (messenger *RecordingMessenger) Messages() []RecordedMessage {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+	return slices.Clone(messenger.messages)
+}
+
+func (messenger *RecordingMessenger) Presences() []RecordedPresence {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+	return slices.Clone(messenger.presences)
+}
+
+func (messenger *RecordingMessenger) Reads() []RecordedRead {
+	messenger.mutex.Lock()
+	defer messenger.mutex.Unlock()
+	return slices.Clone(messenger.reads)
+}
+
+// Waits until at least count messages have been sent, since the message queue sends them in the
+// background. Returns false if that didn't happen within timeout.
+func (messenger *RecordingMessenger) WaitForMessages(count int, timeout time.Duration) ([]RecordedMessage, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		messages := messenger.Messages()
+		if len(messages) >= count {
+			return messages, true
+		}
+		if time.Now().After(deadline) {
+			return messages, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -11,79 +11,17 @@ import (
 	"strings"
 	"time"
 
-	"nbot-wa/constants"
+	"nbot-wa/config"
 	"nbot-wa/util"
 
 	"github.com/dlclark/regexp2"
 	"github.com/go-co-op/gocron/v2"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
-	"google.golang.org/api/calendar/v3"
 )
 
 var rSepharidic = regexp.MustCompile(`(?ims)^\s*se?(?:(?:f)|(?:ph))ara?dic?\s*(?:(?:\s)|(?:$))`)
 
-func parseEventDateTime(t *calendar.EventDateTime) (time.Time, error) {
-	var rtnTime time.Time
-	var err error
-	var location *time.Location = constants.MinyanLocation()
-
-	if len(t.TimeZone) > 0 {
-		location, err = time.LoadLocation(t.TimeZone)
-
-		if err != nil {
-			return time.Time{}, err
-		}
-	}
-
-	if len(t.DateTime) > 0 {
-		rtnTime, err = time.ParseInLocation(time.RFC3339, t.DateTime, location)
-	} else if len(t.Date) > 0 {
-		rtnTime, err = time.ParseInLocation("2006-01-02", t.Date, location)
-	} else {
-		err = errors.New(fmt.Sprint("Fields not specified in received event time", t))
-	}
-
-	if err != nil {
-		return time.Time{}, err
-	}
-
-	return rtnTime.In(constants.MinyanLocation()), nil
-}
-
-type ParsedEvent struct {
-	Name     string
-	DateTime time.Time
-}
-
-func parseEvents(events []*calendar.Event) ([]ParsedEvent, error) {
-	parsedEvents := []ParsedEvent{}
-
-	for _, event := range events {
-		t, err := parseEventDateTime(event.Start)
-		if err != nil {
-			return nil, err
-		}
-
-		parsedEvents = append(parsedEvents, ParsedEvent{
-			Name:     strings.TrimSpace(event.Summary),
-			DateTime: t,
-		})
-	}
-
-	slices.SortFunc(parsedEvents, func(a, b ParsedEvent) int {
-		if a.DateTime.Before(b.DateTime) {
-			return -1
-		} else if b.DateTime.Before(a.DateTime) {
-			return 1
-		} else {
-			return 0
-		}
-	})
-
-	return parsedEvents, nil
-}
-
 func formatMinyanEventDate(builder *strings.Builder, date time.Time) {
 	builder.WriteString(date.Format("Monday, January 2"))
 	builder.WriteString(util.OrdinalSuffix(date.Day()))
@@ -95,18 +33,29 @@ func formatMinyanEventDate(builder *strings.Builder, date time.Time) {
 	}
 }
 
-func areSameDate(d1 time.Time, d2 time.Time) bool {
-	d1 = d1.In(constants.MinyanLocation())
-	d2 = d2.In(constants.MinyanLocation())
+func formatMinyanTime(t time.Time) string {
+	timeString := t.Format(time.Kitchen)
+	// Narrow non-breaking space followed by small-caps AM/PM
+	timeString = strings.Replace(timeString, "AM", "\u202F\u1D00\u1D0D", 1)
+	timeString = strings.Replace(timeString, "PM", "\u202F\u1D18\u1D0D", 1)
+	return timeString
+}
+
+func areSameDate(d1 time.Time, d2 time.Time, location *time.Location) bool {
+	d1 = d1.In(location)
+	d2 = d2.In(location)
 
 	return (d1.Year() == d2.Year()) && (d1.Month() == d2.Month()) && (d1.Day() == d2.Day())
 
 }
 
-func formatMinyanMessage(command *TimesCommand, parsedEvents []ParsedEvent) (string, error) {
+// Returns the message in sections: the header, then one for each day, so that a long message can be
+// split between days
+func formatMinyanMessage(command *TimesCommand, parsedEvents []ParsedEvent) ([]string, error) {
+	sections := []string{}
 	var builder strings.Builder
 
-	singleDayRequested := areSameDate(command.dtStart, command.dtEnd)
+	singleDayRequested := areSameDate(command.dtStart, command.dtEnd, command.location)
 
 	builder.WriteRune('*')
 	builder.WriteString(command.header)
@@ -120,15 +69,18 @@ func formatMinyanMessage(command *TimesCommand, parsedEvents []ParsedEvent) (str
 
 		builder.WriteString("\n(no times to show)")
 	} else {
-		singleDayReturned := areSameDate(parsedEvents[0].DateTime, parsedEvents[len(parsedEvents)-1].DateTime)
+		singleDayReturned := areSameDate(parsedEvents[0].DateTime, parsedEvents[len(parsedEvents)-1].DateTime, command.location)
 		prevDate := time.Time{}
 		first := true
 		for _, event := range parsedEvents {
-			eventDateTime := event.DateTime.In(constants.MinyanLocation())
+			eventDateTime := event.DateTime.In(command.location)
 
 			currDate := startOfDate(eventDateTime)
 			if first || currDate != prevDate {
 				// If we have gone onto a new day, print it
+				sections = append(sections, builder.String())
+				builder.Reset()
+
 				builder.WriteRune('\n')
 				if !singleDayReturned || !first {
 					// Blank line between dates, and before the first if we returned multiple
@@ -139,35 +91,38 @@ func formatMinyanMessage(command *TimesCommand, parsedEvents []ParsedEvent) (str
 				first = false
 			}
 
-			timeString := eventDateTime.Format(time.Kitchen)
-			// Narrow non-breaking space followed by small-caps AM/PM
-			timeString = strings.Replace(timeString, "AM", "\u202F\u1D00\u1D0D", 1)
-			timeString = strings.Replace(timeString, "PM", "\u202F\u1D18\u1D0D", 1)
+			if event.AllDay {
+				fmt.Fprintf(&builder, "\n- *%v*", event.Name)
+				continue
+			}
 
 			fmt.Fprintf(&builder, "\n- *%v*: %v",
 				event.Name,
-				timeString)
+				formatMinyanTime(eventDateTime))
 		}
 	}
 
-	message := builder.String()
+	sections = append(sections, builder.String())
 
 	if command.sephardic {
-		message = strings.ReplaceAll(message, "Shacharis", "Shaharit")
-		message = strings.ReplaceAll(message, "shacharis", "shaharit")
-		message = strings.ReplaceAll(message, "Mincha", "Minha")
-		message = strings.ReplaceAll(message, "mincha", "minha")
-		message = strings.ReplaceAll(message, "Maariv", "Arbit")
-		message = strings.ReplaceAll(message, "maariv", "arbit")
-		message = strings.ReplaceAll(message, "Slichot", "Selihot")
-		message = strings.ReplaceAll(message, "slichot", "selihot")
+		for i, message := range sections {
+			message = strings.ReplaceAll(message, "Shacharis", "Shaharit")
+			message = strings.ReplaceAll(message, "shacharis", "shaharit")
+			message = strings.ReplaceAll(message, "Mincha", "Minha")
+			message = strings.ReplaceAll(message, "mincha", "minha")
+			message = strings.ReplaceAll(message, "Maariv", "Arbit")
+			message = strings.ReplaceAll(message, "maariv", "arbit")
+			message = strings.ReplaceAll(message, "Slichot", "Selihot")
+			message = strings.ReplaceAll(message, "slichot", "selihot")
+			sections[i] = message
+		}
 	}
 
-	return message, nil
+	return sections, nil
 }
 
-func datetimeRangeForDay(date time.Time) (time.Time, time.Time) {
-	dateLoc := date.In(constants.MinyanLocation())
+func datetimeRangeForDay(date time.Time, location *time.Location) (time.Time, time.Time) {
+	dateLoc := date.In(location)
 	todayMidnight := time.Date(dateLoc.Year(), dateLoc.Month(), dateLoc.Day(), 0, 0, 0, 0, dateLoc.Location())
 	tomorrowMidnight := todayMidnight.AddDate(0, 0, 1).Add(-1 * time.Second)
 	return todayMidnight, tomorrowMidnight
@@ -177,27 +132,27 @@ func plusOneWeek(date time.Time) time.Time {
 	return date.AddDate(0, 0, 7).Add(-1 * time.Second)
 }
 
-func (state *ProgramState) GetMinyanEventsForDate(dtStart time.Time, dtEnd time.Time) (*calendar.Events, error) {
-	return state.CalendarEventsService.List(constants.MinyanCalendarID).
-		SingleEvents(true).
-		TimeZone("America/New_York").
-		TimeMin(dtStart.Format(time.RFC3339)).
-		TimeMax(dtEnd.Format(time.RFC3339)).
-		Do()
+func (state *ProgramState) GetMinyanEventsForDate(site *config.Site, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	source, ok := state.EventSources[site.ID]
+	if !ok {
+		return nil, fmt.Errorf("no event source for site %s", site.ID)
+	}
+
+	return source.Events(state.Ctx, dtStart, dtEnd)
 }
 
-func (state *ProgramState) GetMinyanMessage(command *TimesCommand) (string, error) {
-	events, err := state.GetMinyanEventsForDate(command.dtStart, command.dtEnd)
-	if err != nil {
-		return "", err
-	}
+func (state *ProgramState) GetMinyanMessage(command *TimesCommand) ([]string, error) {
+	return state.getMinyanMessageAt(command, time.Now())
+}
 
-	parsedEvents, err := parseEvents(events.Items)
+// Like GetMinyanMessage, but leaves out the minyanim which had passed at now
+func (state *ProgramState) getMinyanMessageAt(command *TimesCommand, now time.Time) ([]string, error) {
+	parsedEvents, err := state.GetMinyanEventsForDate(command.site, command.dtStart, command.dtEnd)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	cutoff := time.Now().In(constants.MinyanLocation()).Add(-5 * time.Minute)
+	cutoff := now.In(command.location).Add(-5 * time.Minute)
 	if !command.includePassed {
 		parsedEvents = util.Filter(parsedEvents, func(event ParsedEvent) bool {
 			return event.DateTime.After(cutoff)
@@ -207,82 +162,110 @@ func (state *ProgramState) GetMinyanMessage(command *TimesCommand) (string, erro
 	return formatMinyanMessage(command, parsedEvents)
 }
 
-func (state *ProgramState) SendMinyanTimes(command *TimesCommand, chat types.JID, shouldSendOnError bool) {
-	message, err := state.GetMinyanMessage(command)
+// Replies to v with the times for command
+func (state *ProgramState) SendMinyanTimes(command *TimesCommand, v *events.Message) {
+	sections, err := state.GetMinyanMessage(command)
 
 	if err != nil {
-		if shouldSendOnError {
-			state.QueueSimpleStringMessage(chat, "```There was an error retrieving the minyan times```")
-		}
-		state.ReportErrorToMe(err, "HandleMinyanMessage")
+		state.QueueReply(v, "```There was an error retrieving the minyan times```")
+		state.ReportErrorToMe(err, "SendMinyanTimes")
 
 		return
 	}
 
-	state.QueueSimpleStringMessage(chat, message)
+	state.QueueReply(v, sections...)
 }
 
-func (state *ProgramState) RegisterDailyEvents() {
-	// Send minyan times for today at 9:30am
-	state.MinyanScheduler.NewJob(
-		gocron.DailyJob(1, gocron.NewAtTimes(gocron.NewAtTime(9, 30, 0))),
-		gocron.NewTask(func() {
-			now := time.Now().In(constants.MinyanLocation())
-
-			_, isYomTov, err := CurrentOrUpcomingYomTov(now)
-
+func (state *ProgramState) RegisterDailyEvents() error {
+	for _, site := range state.Config.Sites {
+		for _, post := range site.ScheduledPosts {
+			// Each site's posts run in that site's timezone
+			_, err := state.MinyanScheduler.NewJob(
+				gocron.CronJob(fmt.Sprintf("CRON_TZ=%s %d %d * * *", site.Location, post.Minute, post.Hour), false),
+				gocron.NewTask(state.SendScheduledPost, site, post),
+			)
 			if err != nil {
-				state.ReportErrorToMe(err, "CurrentOrUpcomingYomTov")
-				return
-			}
-
-			if isYomTov {
-				fmt.Println("Scheduled event did not run since issur melacha is in effect", now)
-				return
+				return err
 			}
 
-			state.SendMinyanTimes(
-				upcomingMinyanTimesCommand(false),
-				constants.ChatIDMinyan(),
-				false)
-		}),
-	)
-
-	// Send minyan times for tomorrow at 8:30pm
-	state.MinyanScheduler.NewJob(
-		gocron.DailyJob(1, gocron.NewAtTimes(gocron.NewAtTime(20, 30, 0))),
-		gocron.NewTask(func() {
-			now := time.Now().In(constants.MinyanLocation())
-
-			_, isYomTov, err := CurrentOrUpcomingYomTov(now)
-
-			if err != nil {
-				state.ReportErrorToMe(err, "CurrentOrUpcomingYomTov")
-				return
-			}
-
-			if isYomTov {
-				fmt.Println("Scheduled event did not run since issur melacha is in effect", now)
-				return
+			// Catch up on a post that was missed because the bot was restarting. If it was in fact
+			// sent, it isn't sent again.
+			if time.Since(lastScheduledPostTime(site, post)) < scheduledPostCatchUp {
+				_, err := state.MinyanScheduler.NewJob(
+					gocron.OneTimeJob(gocron.OneTimeJobStartImmediately()),
+					gocron.NewTask(state.SendScheduledPost, site, post),
+				)
+				if err != nil {
+					return err
+				}
 			}
-
-			state.SendMinyanTimes(
-				upcomingMinyanTimesCommand(false),
-				constants.ChatIDMinyan(),
-				false)
-		}),
-	)
+		}
+	}
 
 	// Send a message every week (Sunday at noon) reminding me to log in to the bot account on my
 	// phone so that the linked device doesn't expire.
 	// This should really be in another file, but the scheduler is here so it's easier
-	state.MinyanScheduler.NewJob(
+	_, err := state.MinyanScheduler.NewJob(
 		gocron.WeeklyJob(1, gocron.NewWeekdays(time.Sunday), gocron.NewAtTimes(gocron.NewAtTime(12, 0, 0))),
 		gocron.NewTask(func() {
-			state.QueueSimpleStringMessage(constants.ChatIDMe(),
+			state.QueueStringMessage(state.Config.ChatIDMe, PriorityAdmin,
 				"*Reminder*: Please log in to the bot account to prevent the linked device from expiring")
 		}),
 	)
+
+	return err
+}
+
+// Posts that were due less than this long ago are sent when the bot starts
+const scheduledPostCatchUp = 30 * time.Minute
+
+// Returns the most recent time the post was due, which may be now
+func lastScheduledPostTime(site *config.Site, post config.ScheduledPost) time.Time {
+	now := time.Now().In(site.Location)
+	t := time.Date(now.Year(), now.Month(), now.Day(), int(post.Hour), int(post.Minute), 0, 0, site.Location)
+	if t.After(now) {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t
+}
+
+func (state *ProgramState) SendScheduledPost(site *config.Site, post config.ScheduledPost) {
+	now := time.Now().In(site.Location)
+
+	_, isYomTov, err := CurrentOrUpcomingYomTov(now, site.ZmanimLocation)
+
+	if err != nil {
+		state.ReportErrorToMe(err, "CurrentOrUpcomingYomTov")
+		return
+	}
+
+	if isYomTov {
+		fmt.Println("Scheduled event did not run since issur melacha is in effect", site.ID, now)
+		return
+	}
+
+	command, err := parseTimeCommand(post.Times, false, site)
+	if err != nil {
+		state.ReportErrorToMe(err, "SendScheduledPost")
+		return
+	}
+
+	sections, err := state.getMinyanMessageAt(command, now)
+	if err != nil {
+		state.ReportErrorToMe(err, "SendScheduledPost")
+		return
+	}
+
+	// Each post goes to each group once a day, however many times the job runs
+	job := fmt.Sprintf("post:%s:%02d:%02d:%s", site.ID, post.Hour, post.Minute, post.Times)
+	date := lastScheduledPostTime(site, post).Format(time.DateOnly)
+	for _, group := range site.Groups {
+		key := fmt.Sprintf("%s|%s|%s", job, group, date)
+		if state.QueueStringMessageOnce(key, group, PriorityBroadcast, sections...) {
+			// So that it can be edited if the schedule changes
+			state.rememberScheduledPost(key, command, now, sections)
+		}
+	}
 }
 
 func startOfDate(d time.Time) time.Time {
@@ -304,14 +287,24 @@ func isDateValid(year int, month int, day int) bool {
 		(day >= 1) && (day <= daysIn(time.Month(month), year)))
 }
 
-func tryMakeDate(year int, month int, day int) (time.Time, error) {
+// The UserError says what is wrong with the date
+func tryMakeDate(year int, month int, day int, location *time.Location) (time.Time, error) {
 	if !isDateValid(year, month, day) {
-		return time.Time{}, fmt.Errorf("invalid date: %d/%d/%d", month, day, year)
+		switch {
+		case month < 1 || month > 12:
+			return time.Time{}, userErrorf("months go from 1 to 12")
+		case year < 1:
+			return time.Time{}, userErrorf("there is no year %d", year)
+		case day < 1:
+			return time.Time{}, userErrorf("days of the month start from 1")
+		default:
+			return time.Time{}, userErrorf("%s has %d days", time.Month(month), daysIn(time.Month(month), year))
+		}
 	}
 
 	return time.Date(year, time.Month(month), day,
 		0, 0, 0, 0,
-		constants.MinyanLocation()), nil
+		location), nil
 }
 
 func nextOccurenceYear(basedate time.Time, month int, day int) int {
@@ -431,10 +424,10 @@ func parseSingleDateFromMatch(prefix string, basedate time.Time, matches map[str
 		daystring := strings.ToLower(v)
 		switch daystring {
 		case "today":
-			d := time.Now().In(constants.MinyanLocation())
+			d := time.Now().In(basedate.Location())
 			return startOfDate(d), ParsedSingleDateType_Today, nil
 		case "tomorrow":
-			d := time.Now().In(constants.MinyanLocation()).AddDate(0, 0, 1)
+			d := time.Now().In(basedate.Location()).AddDate(0, 0, 1)
 			return startOfDate(d), ParsedSingleDateType_Tomorrow, nil
 		}
 		return time.Time{}, 0, fmt.Errorf("Unknown relative date %s", daystring)
@@ -474,8 +467,11 @@ func parseSingleDateFromMatch(prefix string, basedate time.Time, matches map[str
 			year = nextOccurenceYear(basedate, month, day)
 		}
 
-		rtn, err := tryMakeDate(year, month, day)
-		return rtn, ParsedSingleDateType_Date, err
+		rtn, err := tryMakeDate(year, month, day, basedate.Location())
+		if err != nil {
+			return time.Time{}, 0, userErrorf("I couldn't understand `%s` — %s", matches[prefix+"short"], err)
+		}
+		return rtn, ParsedSingleDateType_Date, nil
 
 	} else if _, ok := matches[prefix+"long"]; ok {
 		day, err := strconv.Atoi(matches[prefix+"long_D"])
@@ -495,8 +491,11 @@ func parseSingleDateFromMatch(prefix string, basedate time.Time, matches map[str
 			year = nextOccurenceYear(basedate, month, day)
 		}
 
-		rtn, err := tryMakeDate(year, month, day)
-		return rtn, ParsedSingleDateType_Date, err
+		rtn, err := tryMakeDate(year, month, day, basedate.Location())
+		if err != nil {
+			return time.Time{}, 0, userErrorf("I couldn't understand `%s` — %s", matches[prefix+"long"], err)
+		}
+		return rtn, ParsedSingleDateType_Date, nil
 	}
 	return time.Time{}, 0, fmt.Errorf("Unknown date match %v", matches)
 }
@@ -540,6 +539,8 @@ type TimesCommand struct {
 	header        string
 	sephardic     bool
 	includePassed bool
+	site          *config.Site
+	location      *time.Location
 }
 
 func formatDateStringForSingle(date time.Time, dateType ParsedSingleDateType) string {
@@ -572,9 +573,9 @@ func formatDateStringForMultiple(date time.Time, dateType ParsedSingleDateType)
 	// return ""
 }
 
-func upcomingMinyanTimesCommand(isSephardic bool) *TimesCommand {
-	dtStart := time.Now().In(constants.MinyanLocation())
-	dtEnd := endOfDate(dtStart.AddDate(0, 0, 1));
+func upcomingMinyanTimesCommand(isSephardic bool, site *config.Site) *TimesCommand {
+	dtStart := time.Now().In(site.Location)
+	dtEnd := endOfDate(dtStart.AddDate(0, 0, 1))
 
 	return &TimesCommand{
 		dtStart:       dtStart,
@@ -582,31 +583,26 @@ func upcomingMinyanTimesCommand(isSephardic bool) *TimesCommand {
 		header:        "Upcoming minyan times",
 		sephardic:     isSephardic,
 		includePassed: false,
+		site:          site,
+		location:      site.Location,
 	}
 }
 
-func parseTimeCommand(text string) (*TimesCommand, error) {
-
-	var found bool
-	text, found = strings.CutPrefix(text, "!times")
-	if !found {
-		return nil, errors.New("text does not start with '!times'")
-	}
-
+// Parses the arguments of a `!times` command, after the site name and "sephardic" have been removed.
+// Mistakes in the arguments are returned as a UserError explaining what couldn't be understood.
+func parseTimeCommand(text string, isSephardic bool, site *config.Site) (*TimesCommand, error) {
+	location := site.Location
 	text = strings.TrimSpace(text)
 
-	var isSephardic bool = false
-	text, isSephardic = util.RemoveAndCheckMatch(rSepharidic, text)
-
 	matches := matchRegexGetGroups(dateRangeRegex, text)
 	if matches == nil {
-		return nil, fmt.Errorf("Date did not match: '%s'", text)
+		return nil, explainTimesArgs(text)
 	}
 
 	if _, ok := matches["upcoming"]; ok {
-		return upcomingMinyanTimesCommand(isSephardic), nil
+		return upcomingMinyanTimesCommand(isSephardic, site), nil
 	} else if _, ok := matches["upcomingweek"]; ok {
-		dtStart := startOfDate(time.Now().In(constants.MinyanLocation()))
+		dtStart := startOfDate(time.Now().In(location))
 		dtEnd := plusOneWeek(dtStart)
 
 		return &TimesCommand{
@@ -615,18 +611,20 @@ func parseTimeCommand(text string) (*TimesCommand, error) {
 			header:        "Minyan times for the upcoming week",
 			sephardic:     isSephardic,
 			includePassed: false,
+			site:          site,
+			location:      location,
 		}, nil
 	} else if _, ok := matches["date"]; ok {
 		date, dateType, err := parseSingleDateFromMatch(
 			"date_",
-			time.Now().In(constants.MinyanLocation()),
+			time.Now().In(location),
 			matches)
 
 		if err != nil {
 			return nil, err
 		}
 
-		dtStart, dtEnd := datetimeRangeForDay(date)
+		dtStart, dtEnd := datetimeRangeForDay(date, location)
 
 		headerDateStr := formatDateStringForSingle(date, dateType)
 		return &TimesCommand{
@@ -635,11 +633,13 @@ func parseTimeCommand(text string) (*TimesCommand, error) {
 			header:        "Minyan times for " + headerDateStr,
 			sephardic:     isSephardic,
 			includePassed: true,
+			site:          site,
+			location:      location,
 		}, nil
 	} else if _, ok := matches["weekof"]; ok {
 		date, dateType, err := parseSingleDateFromMatch(
 			"weekof_",
-			time.Now().In(constants.MinyanLocation()),
+			time.Now().In(location),
 			matches)
 
 		if err != nil {
@@ -656,11 +656,13 @@ func parseTimeCommand(text string) (*TimesCommand, error) {
 			header:        "Minyan times for the week of " + headerDateStr,
 			sephardic:     isSephardic,
 			includePassed: true,
+			site:          site,
+			location:      location,
 		}, nil
 	} else if _, ok := matches["to"]; ok {
 		date1, dateType1, err := parseSingleDateFromMatch(
 			"to1_",
-			time.Now().In(constants.MinyanLocation()),
+			time.Now().In(location),
 			matches)
 
 		if err != nil {
@@ -689,50 +691,159 @@ func parseTimeCommand(text string) (*TimesCommand, error) {
 			header:        "Minyan times from " + headerDateStr1 + " to " + headerDateStr2,
 			sephardic:     isSephardic,
 			includePassed: true,
+			site:          site,
+			location:      location,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("Invalid date match. Groups %v, string %q", matches, text)
 }
 
-func (state *ProgramState) HandleMinyanMessage(v *events.Message) {
-	inputText := util.NormalizeString(v.Message.GetConversation())
+func (state *ProgramState) registerMinyanCommands() {
+	state.Commands.Register(&Command{
+		Name:    "!times",
+		Aliases: []string{"!time"},
+		Usage: []CommandUsage{
+			{[]string{"", "upcoming"}, "Displays upcoming minyan times for today and tomorrow"},
+			{[]string{"week"}, "Displays upcoming minyan times for the next 7 days"},
+			{[]string{"DATE"}, "Displays minyan times for `DATE`"},
+			{[]string{"week of DATE"}, "Displays minyan times for the week of `DATE`"},
+			{[]string{"DATE to DATE"}, "Displays minyan times between the first `DATE` and the second `DATE`"},
+		},
+		Notes: []string{
+			"Outside of a minyan's group, put the name of the minyan right after `!times`, e.g. `!times beis midrash week`",
+			strings.Join([]string{
+				"The `DATE` can be in any of the following formats (capitalization doesn't matter):",
+				"- `today` or `tomorrow`",
+				"- A day of the week like `Mon`, `Tuesday`, `Shabbat`, etc.",
+				"- A date in the format `M[M]/D[D][/[YY]YY]`, e.g. `1/21`, `08/15/25`, `11/07/2026`",
+				"- A date in the format `Month DD[th][[,] YYYY]`, e.g. `Jan 21st`, `August 15 2025`, `November 7th, 2000`",
+			}, "\n"),
+		},
+		Section:     SectionMinyan,
+		Chats:       ChatAny,
+		Role:        RoleAnyone,
+		RerunOnEdit: true,
+		Handle:      (*ProgramState).handleTimesCommand,
+	})
 
-	if strings.HasPrefix(inputText, "!times") {
-		command, err := parseTimeCommand(inputText)
-		if err != nil {
-			state.QueueSimpleStringMessage(v.Info.Chat, "```Could not parse the command```")
-			state.ReportErrorToMe(err, "HandleMinyanMessage")
+	state.Commands.Register(&Command{
+		Name:        "!help",
+		Hidden:      true,
+		Chats:       ChatAny,
+		Role:        RoleAnyone,
+		RerunOnEdit: true,
+		Handle: func(state *ProgramState, v *events.Message, args string) {
+			state.QueueReply(v, state.helpMessage(v.Info.Chat, v.Info.IsGroup))
+		},
+	})
+}
+
+// Handles `!times`
+func (state *ProgramState) handleTimesCommand(v *events.Message, args string) {
+	// "sephardic" may come before or after the site name
+	args, isSephardic := util.RemoveAndCheckMatch(rSepharidic, strings.TrimSpace(args))
+	site, args := state.ResolveSite(v.Info.Chat, args)
+	args, isSephardicAfterSite := util.RemoveAndCheckMatch(rSepharidic, args)
+	isSephardic = isSephardic || isSephardicAfterSite
+
+	if site == nil {
+		state.QueueReply(v, state.siteChoiceMessage("!times", "week"))
+		return
+	}
+
+	command, err := parseTimeCommand(args, isSephardic, site)
+	var userErr *UserError
+	if errors.As(err, &userErr) {
+		state.QueueReply(v, userErr.Message)
+		return
+	} else if err != nil {
+		state.QueueReply(v, "```Could not parse the command```")
+		state.ReportErrorToMe(err, "handleTimesCommand")
+		return
+	}
+
+	if len(state.Config.Sites) > 1 {
+		command.header += " at " + site.Name
+	}
+
+	state.SendMinyanTimes(command, v)
+}
+
+// Words in questions to the bot like "when is mincha tomorrow?" which aren't arguments of `!times`
+var timesQuestionFillers = map[string]bool{
+	"when": true, "what": true, "whats": true, "what's": true, "is": true, "are": true, "the": true,
+	"at": true, "on": true, "for": true, "this": true, "please": true, "pls": true,
+	"time": true, "times": true, "minyan": true, "minyanim": true, "davening": true,
+	"shacharis": true, "shacharit": true, "mincha": true, "maariv": true, "arvit": true,
+}
 
-			return
+// Returns the arguments of `!times` in text, a question to the bot, once the filler words are
+// removed. Returns false if the rest isn't something `!times` understands.
+func (state *ProgramState) timesQuestionArgs(chat types.JID, text string) (string, bool) {
+	words := []string{}
+	for _, word := range strings.Fields(text) {
+		word = strings.TrimRight(word, "?!.")
+		if word != "" && !timesQuestionFillers[word] {
+			words = append(words, word)
+		}
+	}
+	args := strings.Join(words, " ")
+
+	// Parsed as handleTimesCommand will, but only to check that it can be. Only the site's
+	// timezone matters for that, so any site will do when the user has to pick one.
+	rest, _ := util.RemoveAndCheckMatch(rSepharidic, args)
+	site, rest := state.ResolveSite(chat, rest)
+	rest, _ = util.RemoveAndCheckMatch(rSepharidic, rest)
+	if site == nil {
+		if len(state.Config.Sites) == 0 {
+			return "", false
 		}
+		site = state.Config.Sites[0]
+	}
+	if _, err := parseTimeCommand(rest, false, site); err != nil {
+		return "", false
+	}
+
+	return args, true
+}
+
+// Finds the site named at the start of args, falling back to DefaultSiteForChat. Returns the site
+// (nil if the user has to pick one) and the rest of args.
+func (state *ProgramState) ResolveSite(chat types.JID, args string) (*config.Site, string) {
+	site, args := state.Config.CutSitePrefix(strings.TrimSpace(args))
+	if site == nil {
+		site = state.DefaultSiteForChat(chat)
+	}
+	return site, args
+}
 
-		state.SendMinyanTimes(command, v.Info.Chat, true)
-	} else if strings.HasPrefix(inputText, "!help") {
-		state.QueueSimpleStringMessage(v.Info.Chat, strings.Join([]string{
-			"*Usage:*",
-			"",
-			"`!times` or `!times upcoming`",
-			"- Displays upcoming minyan times for today and tomorrow",
-			"",
-			"`!times week`",
-			"- Displays upcoming minyan times for the next 7 days",
-			"",
-			"`!times DATE`",
-			"- Displays minyan times for `DATE`",
-			"",
-			"`!times week of DATE`",
-			"- Displays minyan times for the week of `DATE`",
-			"",
-			"`!times DATE to DATE`",
-			"- Displays minyan times between the first `DATE` and the second `DATE`",
-			"",
-			"The `DATE` can be in any of the following formats (capitalization doesn't matter):",
-			"- `today` or `tomorrow`",
-			"- A day of the week like `Mon`, `Tuesday`, `Shabbat`, etc.",
-			"- A date in the format `M[M]/D[D][/[YY]YY]`, e.g. `1/21`, `08/15/25`, `11/07/2026`",
-			"- A date in the format `Month DD[th][[,] YYYY]`, e.g. `Jan 21st`, `August 15 2025`, `November 7th, 2000`",
-		}, "\n"))
+// The site that `!times` refers to in chat when no site is named, or nil if the user has to pick one
+func (state *ProgramState) DefaultSiteForChat(chat types.JID) *config.Site {
+	if site := state.Config.SiteForChat(chat); site != nil {
+		return site
+	}
+	if len(state.Config.Sites) == 1 {
+		return state.Config.Sites[0]
+	}
+	return nil
+}
 
+// Asks the user to name a site, with an example like "`!times beis midrash week`"
+func (state *ProgramState) siteChoiceMessage(command string, exampleArgs string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Please say which minyan you mean, e.g. `%s %s",
+		command, util.NormalizeString(state.Config.Sites[0].Name))
+	if exampleArgs != "" {
+		builder.WriteRune(' ')
+		builder.WriteString(exampleArgs)
+	}
+	builder.WriteString("`. The minyanim are:")
+	for _, site := range state.Config.Sites {
+		fmt.Fprintf(&builder, "\n- %s", site.Name)
+		if len(site.Aliases) > 0 {
+			fmt.Fprintf(&builder, " (or `%s`)", strings.Join(site.Aliases, "`, `"))
+		}
 	}
+	return builder.String()
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	outboxStatusPending = "pending"
+	outboxStatusSent    = "sent"
+	outboxStatusFailed  = "failed"
+
+	// Failed sends are retried after outboxMinBackoff, doubling up to outboxMaxBackoff, and given
+	// up on after outboxMaxAttempts
+	outboxMinBackoff  = 5 * time.Second
+	outboxMaxBackoff  = 10 * time.Minute
+	outboxMaxAttempts = 10
+
+	// How long sent and failed messages, the keys of messages queued once, and which messages
+	// replied to which commands are kept
+	outboxRetention = 7 * 24 * time.Hour
+	// How often what is older than that is deleted
+	outboxCleanupInterval = time.Hour
+
+	// Edits aren't queued this close to the end of WhatsApp's edit window, so that they have time
+	// to be sent
+	outboxEditMargin = 5 * time.Minute
+)
+
+// Messages waiting to be sent, stored in the database so that they survive restarts. Each message
+// is sent at least once: it is only marked as sent once the server acknowledges it. Messages keep
+// the same WhatsApp message ID across attempts, so that a retry after a crash isn't shown twice.
+type Outbox struct {
+	db *sql.DB
+
+	// Signalled when a message is added, to wake up the send loop
+	wake chan struct{}
+}
+
+func NewOutbox(db *sql.DB) *Outbox {
+	return &Outbox{
+		db:   db,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Adds a message to the outbox
+func (outbox *Outbox) Enqueue(ctx context.Context, chat types.JID, message *waE2E.Message, priority MessagePriority) (int64, error) {
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := outbox.insert(ctx, tx, chat, message, priority, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	outbox.signalAdded()
+	return id, nil
+}
+
+// Adds a message to the outbox unless one was already added with the same key. Returns false if
+// it was a duplicate.
+func (outbox *Outbox) EnqueueOnce(ctx context.Context, key string, chat types.JID, message *waE2E.Message, priority MessagePriority) (bool, error) {
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var existing int64
+	err = tx.QueryRowContext(ctx, `SELECT outbox_id FROM outbox_once WHERE key = ?`, key).Scan(&existing)
+	if err == nil {
+		return false, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	id, err := outbox.insert(ctx, tx, chat, message, priority, 0)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbox_once (key, outbox_id, created_at) VALUES (?, ?, ?)`,
+		key, id, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	outbox.signalAdded()
+	return true, nil
+}
+
+// Adds a message to the outbox in tx. If dependsOn isn't 0, the message acts on the one with that
+// outbox ID (e.g. pinning it), and is given up on along with it.
+func (outbox *Outbox) insert(ctx context.Context, tx *sql.Tx, chat types.JID, message *waE2E.Message, priority MessagePriority, dependsOn int64) (int64, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only text messages are tracked until they are delivered, not edits, pins and the like
+	isText := message.Conversation != nil || message.ExtendedTextMessage != nil
+
+	now := time.Now()
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO outbox (chat, message, message_id, status, priority, attempts, next_attempt_at, created_at, is_text, depends_on)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?)`,
+		chat.String(), data, string(whatsmeow.GenerateMessageID()), outboxStatusPending, priority, now.UnixMilli(), now.Unix(), isText, dependsOn)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func (outbox *Outbox) signalAdded() {
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Changes the contents of a message in the outbox. If it hasn't been sent yet it is changed in
+// place (and if it is being sent with the old contents, MarkSent queues an edit), and if it has, an
+// edit is queued. Returns false if it can no longer be changed, because
+// it was sent too long ago, failed, or was cleaned up.
+func (outbox *Outbox) Replace(ctx context.Context, outboxID int64, message *waE2E.Message, priority MessagePriority) (bool, error) {
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var chat, messageID, status string
+	var sentAt sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		`SELECT chat, message_id, status, sent_at FROM outbox WHERE id = ?`,
+		outboxID).Scan(&chat, &messageID, &status, &sentAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case outboxStatusPending:
+		data, err := proto.Marshal(message)
+		if err != nil {
+			return false, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE outbox SET message = ?, version = version + 1 WHERE id = ?`, data, outboxID); err != nil {
+			return false, err
+		}
+
+	case outboxStatusSent:
+		if time.Since(time.Unix(sentAt.Int64, 0)) > whatsmeow.EditWindow-outboxEditMargin {
+			return false, nil
+		}
+
+		jid, err := types.ParseJID(chat)
+		if err != nil {
+			return false, err
+		}
+		if _, err := outbox.insert(ctx, tx, jid, editMessage(jid, messageID, message), priority, 0); err != nil {
+			return false, err
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	outbox.signalAdded()
+	return true, nil
+}
+
+// Returns the WhatsApp message ID that a message will be sent with
+func (outbox *Outbox) messageID(ctx context.Context, tx *sql.Tx, outboxID int64) (types.MessageID, error) {
+	var id types.MessageID
+	err := tx.QueryRowContext(ctx, `SELECT message_id FROM outbox WHERE id = ?`, outboxID).Scan(&id)
+	return id, err
+}
+
+// Returns the outbox ID of the message queued once with key, or 0 if there is none
+func (outbox *Outbox) OnceID(ctx context.Context, key string) (int64, error) {
+	var id int64
+	err := outbox.db.QueryRowContext(ctx, `SELECT outbox_id FROM outbox_once WHERE key = ?`, key).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// A message waiting in the outbox, without its contents
+type PendingMessage struct {
+	OutboxID      int64
+	Chat          string
+	Priority      MessagePriority
+	CreatedAt     time.Time
+	NextAttemptAt time.Time
+}
+
+// Returns the pending messages in the order they were queued
+func (outbox *Outbox) Pending(ctx context.Context) ([]PendingMessage, error) {
+	rows, err := outbox.db.QueryContext(ctx,
+		`SELECT id, chat, priority, created_at, next_attempt_at FROM outbox
+		WHERE status = ?
+		ORDER BY id`,
+		outboxStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []PendingMessage{}
+	for rows.Next() {
+		var msg PendingMessage
+		var createdAt, nextAttemptAt int64
+		if err := rows.Scan(&msg.OutboxID, &msg.Chat, &msg.Priority, &createdAt, &nextAttemptAt); err != nil {
+			return nil, err
+		}
+		msg.CreatedAt = time.Unix(createdAt, 0)
+		msg.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+		pending = append(pending, msg)
+	}
+
+	return pending, rows.Err()
+}
+
+// Signalled when a message is added
+func (outbox *Outbox) Added() <-chan struct{} {
+	return outbox.wake
+}
+
+// Loads a pending message to send it. Returns nil if it can never be sent, in which case it is
+// marked as failed.
+func (outbox *Outbox) Load(ctx context.Context, outboxID int64) (*MessageToSend, error) {
+	msg := MessageToSend{OutboxID: outboxID}
+	var chat string
+	var data []byte
+	err := outbox.db.QueryRowContext(ctx,
+		`SELECT chat, message, message_id, attempts, version FROM outbox WHERE id = ?`,
+		outboxID).Scan(&chat, &data, &msg.ID, &msg.Attempts, &msg.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Message = &waE2E.Message{}
+	msg.Chat, err = types.ParseJID(chat)
+	if err != nil {
+		err = fmt.Errorf("invalid chat %q: %w", chat, err)
+	} else if err = proto.Unmarshal(data, msg.Message); err != nil {
+		err = fmt.Errorf("invalid message: %w", err)
+	}
+	if err != nil {
+		fmt.Printf("Dropping outbox message %d: %v\n", outboxID, err)
+		return nil, outbox.giveUp(ctx, &msg, err)
+	}
+
+	return &msg, nil
+}
+
+// Records that a message was sent. If it was changed by Replace after it was loaded, the old
+// contents were sent, so an edit with the new ones is queued.
+func (outbox *Outbox) MarkSent(ctx context.Context, msg *MessageToSend, response whatsmeow.SendResponse) error {
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE outbox SET status = ?, attempts = attempts + 1, sent_at = ?, last_error = NULL WHERE id = ?`,
+		outboxStatusSent, response.Timestamp.Unix(), msg.OutboxID)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT message, version FROM outbox WHERE id = ?`, msg.OutboxID).Scan(&data, &version)
+	if err != nil {
+		return err
+	}
+	changed := version != msg.Version
+	if changed {
+		current := &waE2E.Message{}
+		if err := proto.Unmarshal(data, current); err != nil {
+			return err
+		}
+		if _, err := outbox.insert(ctx, tx, msg.Chat, editMessage(msg.Chat, msg.ID, current), PriorityInteractive, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if changed {
+		outbox.signalAdded()
+	}
+	return nil
+}
+
+// Deletes the messages sent or given up on more than outboxRetention ago, along with what is kept
+// about them
+func (outbox *Outbox) CleanUp(ctx context.Context) error {
+	before := time.Now().Add(-outboxRetention).Unix()
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`DELETE FROM outbox WHERE status = ? AND sent_at < ?`, []any{outboxStatusSent, before}},
+		{`DELETE FROM outbox WHERE status = ? AND created_at < ?`, []any{outboxStatusFailed, before}},
+		{`DELETE FROM outbox_once WHERE created_at < ?`, []any{before}},
+		{`DELETE FROM message_receipts WHERE message_id NOT IN (SELECT message_id FROM outbox)`, nil},
+		{`DELETE FROM command_replies WHERE created_at < ?`, []any{before}},
+	}
+
+	for _, statement := range statements {
+		if _, err := outbox.db.ExecContext(ctx, statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedules another attempt with exponential backoff, or gives up after outboxMaxAttempts. Returns
+// true if the message won't be retried.
+func (outbox *Outbox) MarkFailed(ctx context.Context, msg *MessageToSend, sendErr error) (bool, error) {
+	msg.Attempts++
+	if msg.Attempts >= outboxMaxAttempts {
+		return true, outbox.giveUp(ctx, msg, sendErr)
+	}
+
+	backoff := min(outboxMinBackoff<<(msg.Attempts-1), outboxMaxBackoff)
+	_, err := outbox.db.ExecContext(ctx,
+		`UPDATE outbox SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?`,
+		msg.Attempts, time.Now().Add(backoff).UnixMilli(), sendErr.Error(), msg.OutboxID)
+	return false, err
+}
+
+// Marks a message as failed, along with the pending messages which act on it
+func (outbox *Outbox) giveUp(ctx context.Context, msg *MessageToSend, reason error) error {
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE outbox SET status = ?, attempts = ?, last_error = ? WHERE id = ?`,
+		outboxStatusFailed, msg.Attempts, reason.Error(), msg.OutboxID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE outbox SET status = ?, last_error = ? WHERE depends_on = ? AND status = ?`,
+		outboxStatusFailed, fmt.Sprintf("message %d failed", msg.OutboxID), msg.OutboxID, outboxStatusPending)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
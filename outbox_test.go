@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestReplaceWhileSendingQueuesEdit(t *testing.T) {
+	state := newTestOutboxState(t)
+	outbox := state.Outbox
+
+	outboxID, err := outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("Mincha at 1:45"), PriorityBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sending, err := outbox.Load(state.Ctx, outboxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := outbox.Replace(state.Ctx, outboxID, stringMessage("Mincha at 2:00"), PriorityInteractive)
+	if err != nil || !edited {
+		t.Fatalf("Replace returned %v, %v", edited, err)
+	}
+	if err := outbox.MarkSent(state.Ctx, sending, whatsmeow.SendResponse{Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := outbox.Pending(state.Ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected an edit to be queued, got %d messages", len(pending))
+	}
+	edit, err := outbox.Load(state.Ctx, pending[0].OutboxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol := edit.Message.GetEditedMessage().GetMessage().GetProtocolMessage()
+	if protocol.GetKey().GetID() != sending.ID || protocol.GetEditedMessage().GetConversation() != "Mincha at 2:00" {
+		t.Errorf("Expected an edit of %v to the new text, got %v", sending.ID, edit.Message)
+	}
+}
+
+func TestReplaceBeforeSendingChangesInPlace(t *testing.T) {
+	state := newTestOutboxState(t)
+	outbox := state.Outbox
+
+	outboxID, err := outbox.Enqueue(state.Ctx, testChatGroup, stringMessage("Mincha at 1:45"), PriorityBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outbox.Replace(state.Ctx, outboxID, stringMessage("Mincha at 2:00"), PriorityInteractive); err != nil {
+		t.Fatal(err)
+	}
+
+	sending, err := outbox.Load(state.Ctx, outboxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := sending.Message.GetConversation(); text != "Mincha at 2:00" {
+		t.Errorf("Expected the new text, got %q", text)
+	}
+	if err := outbox.MarkSent(state.Ctx, sending, whatsmeow.SendResponse{Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := outbox.Pending(state.Ctx); err != nil || len(pending) != 0 {
+		t.Errorf("Expected nothing more to send, got %v, %v", pending, err)
+	}
+}
+
+func TestGivingUpDropsDependentMessages(t *testing.T) {
+	state := newTestOutboxState(t)
+	outbox := state.Outbox
+
+	tx, err := state.DB.BeginTx(state.Ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := outbox.insert(state.Ctx, tx, testChatGroup, stringMessage("Minyan times for the week"), PriorityBroadcast, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outbox.insert(state.Ctx, tx, testChatGroup, pinMessage(testChatGroup, "POST", true), PriorityBroadcast, post); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := outbox.Load(state.Ctx, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Attempts = outboxMaxAttempts - 1
+	if gaveUp, err := outbox.MarkFailed(state.Ctx, msg, errors.New("not a member")); err != nil || !gaveUp {
+		t.Fatalf("MarkFailed returned %v, %v", gaveUp, err)
+	}
+
+	if pending, err := outbox.Pending(state.Ctx); err != nil || len(pending) != 0 {
+		t.Errorf("Expected the pin to be dropped with the post, got %v, %v", pending, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"nbot-wa/config"
+
+	"github.com/go-co-op/gocron/v2"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Once a pinned week can no longer be edited, changes are posted again at most this often, since
+// each repost is a full week's schedule
+const pinnedWeekRepostInterval = 24 * time.Hour
+
+// The message with a week's schedule pinned in a group
+type pinnedWeek struct {
+	week      string
+	outboxID  int64
+	messageID types.MessageID
+	content   string
+	postedAt  time.Time
+}
+
+// Keeps the week's schedule pinned in the groups of the sites which have it
+func (state *ProgramState) RegisterPinnedWeeks() error {
+	for _, site := range state.Config.Sites {
+		if site.PinnedWeek == nil {
+			continue
+		}
+
+		_, err := state.MinyanScheduler.NewJob(
+			gocron.DurationJob(scheduleChangePollInterval),
+			gocron.NewTask(state.UpdatePinnedWeek, site),
+			gocron.WithStartAt(gocron.WithStartImmediately()),
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Posts and pins the week's schedule in the site's groups once it is time to on Sunday, and keeps
+// it up to date. Changes are edited into the message while WhatsApp allows that. After that the
+// updated schedule is posted and pinned in its place, at most once every pinnedWeekRepostInterval.
+func (state *ProgramState) UpdatePinnedWeek(site *config.Site) {
+	ctx, cancel := context.WithTimeout(state.Ctx, scheduleChangePollTimeout)
+	defer cancel()
+
+	now := time.Now().In(site.Location)
+	sunday := startOfDate(now.AddDate(0, 0, -int(now.Weekday())))
+	postAt := time.Date(sunday.Year(), sunday.Month(), sunday.Day(),
+		int(site.PinnedWeek.Hour), int(site.PinnedWeek.Minute), 0, 0, site.Location)
+
+	// Until this week's is posted, last week's is still kept up to date
+	canPost := !now.Before(postAt)
+	if !canPost {
+		sunday = sunday.AddDate(0, 0, -7)
+	}
+
+	_, isYomTov, err := CurrentOrUpcomingYomTov(now, site.ZmanimLocation)
+	if err != nil {
+		state.ReportErrorToMe(err, "CurrentOrUpcomingYomTov")
+		return
+	}
+	if isYomTov {
+		// Caught up on afterwards
+		return
+	}
+
+	sections, err := state.GetMinyanMessage(&TimesCommand{
+		dtStart:       sunday,
+		dtEnd:         plusOneWeek(sunday),
+		header:        "Minyan times for the week of " + formatDateStringForMultiple(sunday, ParsedSingleDateType_Date),
+		includePassed: true,
+		site:          site,
+		location:      site.Location,
+	})
+	if err != nil {
+		state.ReportErrorToMe(err, "UpdatePinnedWeek")
+		return
+	}
+
+	week := sunday.Format(time.DateOnly)
+	for _, group := range site.Groups {
+		if err := state.updatePinnedWeekInGroup(ctx, site, group, week, sections, canPost); err != nil {
+			state.ReportErrorToMe(fmt.Errorf("%s in %v: %w", site.ID, group, err), "UpdatePinnedWeek")
+		}
+	}
+}
+
+func (state *ProgramState) updatePinnedWeekInGroup(ctx context.Context, site *config.Site, group types.JID, week string, sections []string, canPost bool) error {
+	pinned, err := loadPinnedWeek(ctx, state.DB, site.ID, group)
+	if err != nil {
+		return err
+	}
+
+	content := strings.Join(sections, "")
+	if pinned == nil || pinned.week != week {
+		if !canPost {
+			return nil
+		}
+		return state.postPinnedWeek(ctx, site, group, week, sections, content, pinned)
+	}
+
+	if content == pinned.content {
+		return nil
+	}
+
+	// Edits are urgent, since they can only be made for a short time
+	sections = append(sections, scheduledPostUpdatedMarker)
+	edited, err := state.Outbox.Replace(ctx, pinned.outboxID, stringMessage(state.pinnedWeekText(sections)), PriorityInteractive)
+	if err != nil {
+		return err
+	}
+	if !edited {
+		if time.Since(pinned.postedAt) < pinnedWeekRepostInterval {
+			// The content isn't saved, so the changes are posted once the interval is up
+			return nil
+		}
+		return state.postPinnedWeek(ctx, site, group, week, sections, content, pinned)
+	}
+
+	fmt.Printf("Edited the pinned week in %v\n", group)
+	_, err = state.DB.ExecContext(ctx,
+		`UPDATE pinned_weeks SET content = ? WHERE site_id = ? AND chat = ?`,
+		content, site.ID, group.String())
+	return err
+}
+
+// Posts the schedule and pins it in place of the previously pinned message, if any. Everything is
+// queued in one transaction, so that it isn't posted again if recording it fails.
+func (state *ProgramState) postPinnedWeek(ctx context.Context, site *config.Site, group types.JID, week string, sections []string, content string, previous *pinnedWeek) error {
+	tx, err := state.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	outboxID, err := state.Outbox.insert(ctx, tx, group, stringMessage(state.pinnedWeekText(sections)), PriorityBroadcast, 0)
+	if err != nil {
+		return err
+	}
+	messageID, err := state.Outbox.messageID(ctx, tx, outboxID)
+	if err != nil {
+		return err
+	}
+
+	// A chat's messages of the same priority are sent in the order they were queued, so the
+	// message is sent before it is pinned. If it can't be sent, the old one stays pinned.
+	if _, err := state.Outbox.insert(ctx, tx, group, pinMessage(group, messageID, true), PriorityBroadcast, outboxID); err != nil {
+		return err
+	}
+	if previous != nil {
+		if _, err := state.Outbox.insert(ctx, tx, group, pinMessage(group, previous.messageID, false), PriorityBroadcast, outboxID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO pinned_weeks (site_id, chat, week, outbox_id, message_id, content, posted_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		site.ID, group.String(), week, outboxID, messageID, content, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Posted the pinned week in %v\n", group)
+	state.Outbox.signalAdded()
+	return nil
+}
+
+// A pinned message can't be split, so the schedule is cut short if it doesn't fit in one
+func (state *ProgramState) pinnedWeekText(sections []string) string {
+	return splitMessage(sections, state.Config.Sending.MaxMessageLength, 1, "")[0]
+}
+
+func loadPinnedWeek(ctx context.Context, db *sql.DB, siteID string, chat types.JID) (*pinnedWeek, error) {
+	var pinned pinnedWeek
+	var postedAt int64
+	err := db.QueryRowContext(ctx,
+		`SELECT week, outbox_id, message_id, content, posted_at FROM pinned_weeks WHERE site_id = ? AND chat = ?`,
+		siteID, chat.String()).Scan(&pinned.week, &pinned.outboxID, &pinned.messageID, &pinned.content, &postedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pinned.postedAt = time.Unix(postedAt, 0)
+	return &pinned, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"nbot-wa/config"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+const (
+	// Scheduled posts are checked for changes for this long after they are posted. WhatsApp only
+	// allows edits for a short time after a message is sent (whatsmeow.EditWindow); later changes
+	// are left to the change announcements.
+	scheduledPostEditRetention = time.Hour
+
+	// Added to a post which has been edited
+	scheduledPostUpdatedMarker = "\n\n_(updated)_"
+)
+
+// A scheduled post as it was sent to one group
+type scheduledPost struct {
+	key      string
+	command  *TimesCommand
+	postedAt time.Time
+	parts    int
+	content  string
+}
+
+// Remembers a scheduled post which was just queued, so that it can be edited if the schedule
+// changes
+func (state *ProgramState) rememberScheduledPost(key string, command *TimesCommand, postedAt time.Time, sections []string) {
+	_, err := state.DB.ExecContext(state.Ctx,
+		`INSERT OR REPLACE INTO scheduled_posts (key, site_id, header, dt_start, dt_end, include_passed, posted_at, parts, content)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, command.site.ID, command.header, command.dtStart.Unix(), command.dtEnd.Unix(), command.includePassed,
+		postedAt.Unix(), len(state.splitMessage(sections)), strings.Join(sections, ""))
+	if err != nil {
+		state.ReportErrorToMe(err, "rememberScheduledPost")
+	}
+}
+
+// Checks recent scheduled posts for changes every few minutes
+func (state *ProgramState) RegisterScheduledPostEdits() error {
+	hasPosts := false
+	for _, site := range state.Config.Sites {
+		hasPosts = hasPosts || len(site.ScheduledPosts) > 0
+	}
+	if !hasPosts {
+		return nil
+	}
+
+	_, err := state.MinyanScheduler.NewJob(
+		gocron.DurationJob(scheduleChangePollInterval),
+		gocron.NewTask(state.EditScheduledPosts),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	return err
+}
+
+// Edits the recent scheduled posts whose minyanim have changed since they were posted
+func (state *ProgramState) EditScheduledPosts() {
+	ctx, cancel := context.WithTimeout(state.Ctx, scheduleChangePollTimeout)
+	defer cancel()
+
+	_, err := state.DB.ExecContext(ctx,
+		`DELETE FROM scheduled_posts WHERE posted_at < ?`,
+		time.Now().Add(-scheduledPostEditRetention).Unix())
+	if err != nil {
+		state.ReportErrorToMe(err, "EditScheduledPosts")
+		return
+	}
+
+	posts, err := state.loadScheduledPosts(ctx)
+	if err != nil {
+		state.ReportErrorToMe(err, "EditScheduledPosts")
+		return
+	}
+
+	for _, post := range posts {
+		if err := state.editScheduledPost(ctx, post); err != nil {
+			state.ReportErrorToMe(fmt.Errorf("post %s: %w", post.key, err), "EditScheduledPosts")
+		}
+	}
+}
+
+func (state *ProgramState) loadScheduledPosts(ctx context.Context) ([]*scheduledPost, error) {
+	rows, err := state.DB.QueryContext(ctx,
+		`SELECT key, site_id, header, dt_start, dt_end, include_passed, posted_at, parts, content FROM scheduled_posts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []*scheduledPost{}
+	for rows.Next() {
+		var siteID string
+		var dtStart, dtEnd, postedAt int64
+		post := &scheduledPost{command: &TimesCommand{}}
+		err := rows.Scan(&post.key, &siteID, &post.command.header, &dtStart, &dtEnd,
+			&post.command.includePassed, &postedAt, &post.parts, &post.content)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sites may have been removed from the config since
+		site := state.siteByID(siteID)
+		if site == nil {
+			continue
+		}
+
+		post.command.site = site
+		post.command.location = site.Location
+		post.command.dtStart = time.Unix(dtStart, 0).In(site.Location)
+		post.command.dtEnd = time.Unix(dtEnd, 0).In(site.Location)
+		post.postedAt = time.Unix(postedAt, 0)
+		posts = append(posts, post)
+	}
+
+	return posts, rows.Err()
+}
+
+func (state *ProgramState) siteByID(id string) *config.Site {
+	for _, site := range state.Config.Sites {
+		if site.ID == id {
+			return site
+		}
+	}
+	return nil
+}
+
+// Edits the post if its minyanim have changed, marking it as updated. Once the post can no longer
+// be edited it is forgotten.
+func (state *ProgramState) editScheduledPost(ctx context.Context, post *scheduledPost) error {
+	// Minyanim which had passed when it was posted stay left out
+	sections, err := state.getMinyanMessageAt(post.command, post.postedAt)
+	if err != nil {
+		return err
+	}
+
+	content := strings.Join(sections, "")
+	if content == post.content {
+		return nil
+	}
+
+	// The marker doesn't change how the post is split, so it has as many parts as when it was
+	// posted unless the schedule itself has grown or shrunk
+	sending := state.Config.Sending
+	parts := splitMessage(sections, sending.MaxMessageLength, sending.MaxMessageParts, scheduledPostUpdatedMarker)
+	if len(parts) != post.parts {
+		// Parts can't be added to or removed from the post
+		fmt.Printf("Not editing post %s, which now has %d parts instead of %d\n", post.key, len(parts), post.parts)
+		return state.forgetScheduledPost(ctx, post)
+	}
+
+	for i, part := range parts {
+		outboxID, err := state.Outbox.OnceID(ctx, messagePartKey(post.key, i))
+		if err != nil {
+			return err
+		}
+
+		// Edits are urgent, since they can only be made for a short time
+		edited := false
+		if outboxID != 0 {
+			edited, err = state.Outbox.Replace(ctx, outboxID, stringMessage(part), PriorityInteractive)
+			if err != nil {
+				return err
+			}
+		}
+		if !edited {
+			fmt.Printf("Post %s can no longer be edited\n", post.key)
+			return state.forgetScheduledPost(ctx, post)
+		}
+	}
+
+	fmt.Printf("Edited post %s\n", post.key)
+	_, err = state.DB.ExecContext(ctx,
+		`UPDATE scheduled_posts SET content = ? WHERE key = ?`,
+		content, post.key)
+	return err
+}
+
+func (state *ProgramState) forgetScheduledPost(ctx context.Context, post *scheduledPost) error {
+	_, err := state.DB.ExecContext(ctx, `DELETE FROM scheduled_posts WHERE key = ?`, post.key)
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	// Sent messages with no delivery receipt after deliveryTimeout are reported to the maintainer.
+	// Only messages sent in the last deliveryCheckWindow are checked.
+	deliveryTimeout       = 15 * time.Minute
+	deliveryCheckInterval = 5 * time.Minute
+	deliveryCheckWindow   = 24 * time.Hour
+
+	// What `!delivery` shows
+	recentBroadcastsWindow = 3 * 24 * time.Hour
+	recentBroadcastsLimit  = 10
+)
+
+// How far a text message from the outbox has got
+type DeliveryStatus struct {
+	OutboxID  int64
+	Chat      string
+	Status    string
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	// Zero if it hasn't been sent
+	SentAt time.Time
+
+	// How many recipients (in groups, members) it was delivered to and read by
+	DeliveredTo int
+	ReadBy      int
+}
+
+// Records a receipt for a message the bot sent. Receipts for other messages are ignored.
+func (outbox *Outbox) RecordReceipt(ctx context.Context, messageIDs []types.MessageID, participant types.JID, read bool, at time.Time) error {
+	var readAt sql.NullInt64
+	if read {
+		readAt = sql.NullInt64{Int64: at.Unix(), Valid: true}
+	}
+
+	for _, id := range messageIDs {
+		// Being read implies being delivered, and the first receipt of each kind is kept
+		_, err := outbox.db.ExecContext(ctx,
+			`INSERT INTO message_receipts (message_id, participant, delivered_at, read_at)
+			SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM outbox WHERE message_id = ?)
+			ON CONFLICT (message_id, participant) DO UPDATE SET
+				delivered_at = COALESCE(delivered_at, excluded.delivered_at),
+				read_at = COALESCE(read_at, excluded.read_at)`,
+			id, participant.String(), at.Unix(), readAt, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the most recent text messages queued since the given time with the given priority, most
+// recent first
+func (outbox *Outbox) RecentDeliveries(ctx context.Context, priority MessagePriority, since time.Time, limit int) ([]DeliveryStatus, error) {
+	return outbox.deliveryStatuses(ctx,
+		`o.priority = ? AND o.created_at >= ? ORDER BY o.id DESC LIMIT ?`,
+		priority, since.Unix(), limit)
+}
+
+// Returns the text messages sent between sentAfter and sentBefore which haven't been delivered to
+// anyone and haven't been reported yet, except those sent to excludeChat
+func (outbox *Outbox) Undelivered(ctx context.Context, sentAfter time.Time, sentBefore time.Time, excludeChat types.JID) ([]DeliveryStatus, error) {
+	return outbox.deliveryStatuses(ctx,
+		`o.status = ? AND NOT o.undelivered_reported AND o.sent_at BETWEEN ? AND ? AND o.chat != ?
+		AND NOT EXISTS (SELECT 1 FROM message_receipts r WHERE r.message_id = o.message_id AND r.delivered_at IS NOT NULL)
+		ORDER BY o.id`,
+		outboxStatusSent, sentAfter.Unix(), sentBefore.Unix(), excludeChat.String())
+}
+
+func (outbox *Outbox) MarkUndeliveredReported(ctx context.Context, outboxIDs []int64) error {
+	for _, id := range outboxIDs {
+		if _, err := outbox.db.ExecContext(ctx, `UPDATE outbox SET undelivered_reported = 1 WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the statuses of the text messages matching the condition on o (the outbox), which may
+// end with ORDER BY and LIMIT
+func (outbox *Outbox) deliveryStatuses(ctx context.Context, condition string, args ...any) ([]DeliveryStatus, error) {
+	rows, err := outbox.db.QueryContext(ctx,
+		`SELECT o.id, o.chat, o.status, o.attempts, COALESCE(o.last_error, ''), o.created_at, COALESCE(o.sent_at, 0),
+			(SELECT COUNT(r.delivered_at) FROM message_receipts r WHERE r.message_id = o.message_id),
+			(SELECT COUNT(r.read_at) FROM message_receipts r WHERE r.message_id = o.message_id)
+		FROM outbox o
+		WHERE o.is_text AND `+condition,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []DeliveryStatus{}
+	for rows.Next() {
+		var status DeliveryStatus
+		var createdAt, sentAt int64
+		err := rows.Scan(&status.OutboxID, &status.Chat, &status.Status, &status.Attempts, &status.LastError,
+			&createdAt, &sentAt, &status.DeliveredTo, &status.ReadBy)
+		if err != nil {
+			return nil, err
+		}
+
+		status.CreatedAt = time.Unix(createdAt, 0)
+		if sentAt != 0 {
+			status.SentAt = time.Unix(sentAt, 0)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, rows.Err()
+}
+
+func (state *ProgramState) HandleReceipt(v *events.Receipt) {
+	var read bool
+	switch v.Type {
+	case types.ReceiptTypeDelivered:
+		read = false
+	case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+		read = true
+	default:
+		// Receipts from the bot's other devices, retries and the like
+		return
+	}
+
+	if err := state.Outbox.RecordReceipt(state.Ctx, v.MessageIDs, v.Sender.ToNonAD(), read, v.Timestamp); err != nil {
+		fmt.Println("Error recording receipt:", err)
+	}
+}
+
+// Checks every few minutes for messages which weren't delivered
+func (state *ProgramState) RegisterDeliveryCheck() error {
+	_, err := state.MinyanScheduler.NewJob(
+		gocron.DurationJob(deliveryCheckInterval),
+		gocron.NewTask(state.CheckDeliveries),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	return err
+}
+
+// Reports the messages which haven't been delivered within deliveryTimeout of being sent
+func (state *ProgramState) CheckDeliveries() {
+	now := time.Now()
+	// Reports to the maintainer's own chat would be just as undelivered
+	undelivered, err := state.Outbox.Undelivered(state.Ctx, now.Add(-deliveryCheckWindow), now.Add(-deliveryTimeout), state.Config.ChatIDMe)
+	if err != nil {
+		state.ReportErrorToMe(err, "CheckDeliveries")
+		return
+	}
+	if len(undelivered) == 0 {
+		return
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "*Not delivered after %v:*", deliveryTimeout)
+	outboxIDs := []int64{}
+	for _, status := range undelivered {
+		fmt.Fprintf(&builder, "\n- %s, sent %s", state.chatName(status.Chat), state.formatDeliveryTime(status.SentAt))
+		outboxIDs = append(outboxIDs, status.OutboxID)
+	}
+
+	state.QueueStringMessage(state.Config.ChatIDMe, PriorityAdmin, builder.String())
+	if err := state.Outbox.MarkUndeliveredReported(state.Ctx, outboxIDs); err != nil {
+		state.ReportErrorToMe(err, "CheckDeliveries")
+	}
+}
+
+// Lists the recent broadcasts and how far they got, for `!delivery`
+func (state *ProgramState) deliveryStatusMessage() string {
+	statuses, err := state.Outbox.RecentDeliveries(state.Ctx, PriorityBroadcast, time.Now().Add(-recentBroadcastsWindow), recentBroadcastsLimit)
+	if err != nil {
+		state.ReportErrorToMe(err, "deliveryStatusMessage")
+		return "```There was an error reading the outbox```"
+	}
+	if len(statuses) == 0 {
+		return "```There were no broadcasts in the last 3 days```"
+	}
+
+	var builder strings.Builder
+	builder.WriteString("*Recent broadcasts:*")
+	for _, status := range statuses {
+		fmt.Fprintf(&builder, "\n\n%s\n%s\n", state.formatDeliveryTime(status.CreatedAt), state.chatName(status.Chat))
+
+		switch {
+		case status.Status == outboxStatusFailed:
+			fmt.Fprintf(&builder, "Failed after %d attempts: ```%s```", status.Attempts, status.LastError)
+		case status.Status == outboxStatusPending && status.Attempts > 0:
+			fmt.Fprintf(&builder, "Not sent yet, %d failed attempts: ```%s```", status.Attempts, status.LastError)
+		case status.Status == outboxStatusPending:
+			builder.WriteString("Not sent yet")
+		case status.DeliveredTo == 0:
+			fmt.Fprintf(&builder, "Sent %s, not delivered yet", state.formatDeliveryTime(status.SentAt))
+		default:
+			fmt.Fprintf(&builder, "Sent %s, delivered to %d, read by %d",
+				state.formatDeliveryTime(status.SentAt), status.DeliveredTo, status.ReadBy)
+		}
+	}
+
+	return builder.String()
+}
+
+func (state *ProgramState) formatDeliveryTime(t time.Time) string {
+	return t.In(state.Config.Location).Format("Mon Jan 2 3:04 PM")
+}
+
+// Describes a chat the bot sends to, e.g. "Beis Midrash group (123@g.us)"
+func (state *ProgramState) chatName(chat string) string {
+	jid, err := types.ParseJID(chat)
+	if err != nil {
+		return chat
+	}
+
+	switch {
+	case jid == state.Config.ChatIDMe:
+		return "Me"
+	case jid == state.Config.ChatIDBotTest:
+		return "Bot test group"
+	}
+	if site := state.Config.SiteForChat(jid); site != nil {
+		return fmt.Sprintf("%s group (%s)", site.Name, chat)
+	}
+	return chat
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"nbot-wa/config"
+
+	"github.com/dlclark/regexp2"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	scheduleDateFormat = "2006-01-02"
+
+	allWeekdays  uint8 = 0b1111111
+	sundayFriday uint8 = 0b0111111
+	mondayFriday uint8 = 0b0111110
+)
+
+var (
+	rScheduleTime = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?\s*([ap]\.?m\.?)?$`)
+	rWeekdayRange = regexp.MustCompile(`^([a-z]+)-([a-z]+)$`)
+
+	scheduleDateRegex = regexp2.MustCompile(fmt.Sprintf(`(?ims)^\s*%s\s*$`, singleDateRegex("date_")), regexp2.RE2)
+)
+
+var scheduleDayGroups = map[string]uint8{
+	"daily":     allWeekdays,
+	"everyday":  allWeekdays,
+	"every day": allWeekdays,
+	"weekdays":  sundayFriday, // Every day but Shabbos, as in a shul's schedule
+}
+
+// A minyan in a site's local schedule, which is either weekly or on a single date
+type ScheduleEntry struct {
+	ID     int64
+	Name   string
+	Minute int // Minutes after midnight
+
+	// Bitmask of time.Weekday, for weekly minyanim
+	Weekdays uint8
+	// For one-time minyanim
+	Date time.Time
+}
+
+func (entry *ScheduleEntry) occursOn(date time.Time) bool {
+	if entry.Weekdays == 0 {
+		return areSameDate(entry.Date, date, date.Location())
+	}
+	return entry.Weekdays&(1<<date.Weekday()) != 0
+}
+
+// An EventSource for a schedule stored in the bot's database and managed from chat
+type LocalEventSource struct {
+	db       *sql.DB
+	siteID   string
+	location *time.Location
+}
+
+func NewLocalEventSource(db *sql.DB, siteID string, location *time.Location) *LocalEventSource {
+	return &LocalEventSource{
+		db:       db,
+		siteID:   siteID,
+		location: location,
+	}
+}
+
+func (source *LocalEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	entries, err := listScheduleEntries(ctx, source.db, source.siteID, source.location)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedEvents := []ParsedEvent{}
+	for day := startOfDate(dtStart.In(source.location)); !day.After(dtEnd); day = day.AddDate(0, 0, 1) {
+		for _, entry := range entries {
+			if !entry.occursOn(day) {
+				continue
+			}
+
+			t := time.Date(day.Year(), day.Month(), day.Day(), entry.Minute/60, entry.Minute%60, 0, 0, source.location)
+			if t.Before(dtStart) || t.After(dtEnd) {
+				continue
+			}
+
+			parsedEvents = append(parsedEvents, ParsedEvent{
+				Name:     entry.Name,
+				DateTime: t,
+			})
+		}
+	}
+
+	sortParsedEvents(parsedEvents)
+	return parsedEvents, nil
+}
+
+func listScheduleEntries(ctx context.Context, db *sql.DB, siteID string, location *time.Location) ([]ScheduleEntry, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, name, minute, weekdays, COALESCE(date, '') FROM minyan_schedule
+		WHERE site_id = ?
+		ORDER BY weekdays = 0, date, minute, id`,
+		siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ScheduleEntry{}
+	for rows.Next() {
+		var entry ScheduleEntry
+		var date string
+		if err := rows.Scan(&entry.ID, &entry.Name, &entry.Minute, &entry.Weekdays, &date); err != nil {
+			return nil, err
+		}
+
+		if date != "" {
+			entry.Date, err = time.ParseInLocation(scheduleDateFormat, date, location)
+			if err != nil {
+				return nil, fmt.Errorf("schedule entry %d: %w", entry.ID, err)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func addScheduleEntry(ctx context.Context, db *sql.DB, siteID string, entry *ScheduleEntry, createdBy string) error {
+	var date any
+	if entry.Weekdays == 0 {
+		date = entry.Date.Format(scheduleDateFormat)
+	}
+
+	result, err := db.ExecContext(ctx,
+		`INSERT INTO minyan_schedule (site_id, name, minute, weekdays, date, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		siteID, entry.Name, entry.Minute, entry.Weekdays, date, createdBy, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// Returns false if there was no entry with that ID for the site
+func removeScheduleEntry(ctx context.Context, db *sql.DB, siteID string, id int64) (bool, error) {
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM minyan_schedule WHERE site_id = ? AND id = ?`,
+		siteID, id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count != 0, err
+}
+
+// Parses the arguments of `!addtime`: "NAME DAYS TIME", e.g. "mincha gedola sun-thu 1:45pm"
+func parseAddTimeCommand(args string, location *time.Location) (*ScheduleEntry, error) {
+	tokens := strings.Fields(args)
+
+	// Allow a space before am/pm
+	if n := len(tokens); n >= 2 && rScheduleTime.MatchString(tokens[n-2]+tokens[n-1]) {
+		tokens = append(tokens[:n-2], tokens[n-2]+tokens[n-1])
+	}
+
+	if len(tokens) < 3 {
+		return nil, errors.New("Usage: `!addtime NAME DAYS TIME`, e.g. `!addtime mincha weekdays 1:45pm`")
+	}
+
+	minute, err := parseScheduleTime(tokens[len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	// The name is as short as possible, so that everything after it is the days
+	tokens = tokens[:len(tokens)-1]
+	for split := 1; split < len(tokens); split++ {
+		weekdays, date, ok := parseScheduleDays(strings.Join(tokens[split:], " "), location)
+		if !ok {
+			continue
+		}
+
+		return &ScheduleEntry{
+			Name:     capitalizeWords(strings.Join(tokens[:split], " ")),
+			Minute:   minute,
+			Weekdays: weekdays,
+			Date:     date,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Could not understand the days in `%s`. Use `daily`, `weekdays`, a day like `sun`, a range like `sun-thu`, a list like `mon,wed` or a date", strings.Join(tokens[1:], " "))
+}
+
+// Parses a time like "1:45pm", "7am" or "13:45" into minutes after midnight
+func parseScheduleTime(s string) (int, error) {
+	match := rScheduleTime.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("Could not understand the time `%s`. Use a time like `1:45pm` or `13:45`", s)
+	}
+
+	hour, _ := strconv.Atoi(match[1])
+	minute := 0
+	if match[2] != "" {
+		minute, _ = strconv.Atoi(match[2])
+	}
+
+	if suffix := strings.ReplaceAll(match[3], ".", ""); suffix != "" {
+		if hour < 1 || hour > 12 {
+			return 0, fmt.Errorf("`%s` is not a valid time", s)
+		}
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	}
+
+	if hour > 23 || minute > 59 {
+		return 0, fmt.Errorf("`%s` is not a valid time", s)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// Parses the days of an `!addtime` command. Returns a weekday bitmask for weekly minyanim, or a
+// date for one-time minyanim.
+func parseScheduleDays(s string, location *time.Location) (uint8, time.Time, bool) {
+	if weekdays, ok := scheduleDayGroups[s]; ok {
+		return weekdays, time.Time{}, true
+	}
+
+	var weekdays uint8
+	valid := true
+	for _, part := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		if weekday, ok := dayOfWeekMap[part]; ok {
+			weekdays |= 1 << weekday
+		} else if match := rWeekdayRange.FindStringSubmatch(part); match != nil {
+			from, fromOk := dayOfWeekMap[match[1]]
+			to, toOk := dayOfWeekMap[match[2]]
+			if !fromOk || !toOk {
+				valid = false
+				break
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				weekdays |= 1 << day
+				if day == to {
+					break
+				}
+			}
+		} else {
+			valid = false
+			break
+		}
+	}
+	if valid && weekdays != 0 {
+		return weekdays, time.Time{}, true
+	}
+
+	if matches := matchRegexGetGroups(scheduleDateRegex, s); matches != nil {
+		date, _, err := parseSingleDateFromMatch("date_", time.Now().In(location), matches)
+		if err == nil {
+			return 0, date, true
+		}
+	}
+
+	return 0, time.Time{}, false
+}
+
+func capitalizeWords(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		first, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(first)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+func formatScheduleWeekdays(weekdays uint8) string {
+	switch weekdays {
+	case allWeekdays:
+		return "Every day"
+	case sundayFriday:
+		return "Sun-Fri"
+	case mondayFriday:
+		return "Mon-Fri"
+	}
+
+	days := []string{}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if weekdays&(1<<day) != 0 {
+			days = append(days, day.String()[:3])
+		}
+	}
+	return strings.Join(days, ", ")
+}
+
+func formatScheduleEntry(entry *ScheduleEntry, location *time.Location) string {
+	var days string
+	if entry.Weekdays == 0 {
+		var builder strings.Builder
+		formatMinyanEventDate(&builder, entry.Date)
+		days = builder.String()
+	} else {
+		days = formatScheduleWeekdays(entry.Weekdays)
+	}
+
+	t := time.Date(2000, 1, 1, entry.Minute/60, entry.Minute%60, 0, 0, location)
+	return fmt.Sprintf("#%d *%s*: %s at %s", entry.ID, entry.Name, days, formatMinyanTime(t))
+}
+
+func (state *ProgramState) registerScheduleCommands() {
+	state.Commands.Register(&Command{
+		Name: "!addtime",
+		Usage: []CommandUsage{{[]string{"NAME DAYS TIME"},
+			"Adds a minyan, e.g. `!addtime mincha weekdays 1:45pm`. `DAYS` can be `daily`, `weekdays` (Sun-Fri), a day like `sun`, a range like `sun-thu`, a list like `mon,wed`, or a `DATE` for a one-time minyan"}},
+		Section: SectionGabbai,
+		Chats:   ChatAny,
+		Role:    RoleGabbai,
+		Handle:  (*ProgramState).handleAddTimeCommand,
+	})
+
+	state.Commands.Register(&Command{
+		Name:    "!removetime",
+		Usage:   []CommandUsage{{[]string{"NUMBER"}, "Removes the minyan with the number shown by `!listtimes`"}},
+		Section: SectionGabbai,
+		Chats:   ChatAny,
+		Role:    RoleGabbai,
+		Handle:  (*ProgramState).handleRemoveTimeCommand,
+	})
+
+	state.Commands.Register(&Command{
+		Name:        "!listtimes",
+		Usage:       []CommandUsage{{[]string{""}, "Lists the schedule"}},
+		Section:     SectionGabbai,
+		Chats:       ChatAny,
+		Role:        RoleAnyone,
+		RerunOnEdit: true,
+		Handle:      (*ProgramState).handleListTimesCommand,
+	})
+}
+
+// Handles `!addtime`
+func (state *ProgramState) handleAddTimeCommand(v *events.Message, args string) {
+	site, args := state.resolveScheduleSite(v, "!addtime", args, true)
+	if site == nil {
+		return
+	}
+
+	reply, err := state.addTime(site, args, v.Info.Sender.String())
+	state.replyWithScheduleResult(v, reply, err)
+}
+
+// Handles `!removetime`
+func (state *ProgramState) handleRemoveTimeCommand(v *events.Message, args string) {
+	site, args := state.resolveScheduleSite(v, "!removetime", args, true)
+	if site == nil {
+		return
+	}
+
+	reply, err := state.removeTime(site, args)
+	state.replyWithScheduleResult(v, reply, err)
+}
+
+// Handles `!listtimes`
+func (state *ProgramState) handleListTimesCommand(v *events.Message, args string) {
+	site, _ := state.resolveScheduleSite(v, "!listtimes", args, false)
+	if site == nil {
+		return
+	}
+
+	reply, err := state.listTimes(site)
+	state.replyWithScheduleResult(v, reply, err)
+}
+
+// Finds the site named at the start of args (or the chat's site), whose schedule must be kept by
+// the bot. The registry only checks that the user is a gabbai of some site, so for commands which
+// change the schedule this checks that they are a gabbai of this one. Replies and returns nil if
+// the command can't be used on the site.
+func (state *ProgramState) resolveScheduleSite(v *events.Message, command string, args string, changes bool) (*config.Site, string) {
+	site, args := state.ResolveSite(v.Info.Chat, args)
+	if site == nil {
+		state.QueueReply(v, state.siteChoiceMessage(command, ""))
+		return nil, ""
+	}
+
+	if site.Calendar.Type != config.CalendarTypeLocal {
+		state.QueueReply(v,
+			fmt.Sprintf("```The times for %s come from its calendar, please change them there```", site.Name))
+		return nil, ""
+	}
+
+	if changes && !state.canManageSchedule(site, v) {
+		state.QueueReply(v, fmt.Sprintf("```Only the gabbaim of %s can change its schedule```", site.Name))
+		return nil, ""
+	}
+
+	return site, args
+}
+
+func (state *ProgramState) replyWithScheduleResult(v *events.Message, reply string, err error) {
+	if err != nil {
+		state.QueueReply(v, "```There was an error updating the schedule```")
+		state.ReportErrorToMe(err, "replyWithScheduleResult")
+		return
+	}
+
+	state.QueueReply(v, reply)
+}
+
+func (state *ProgramState) canManageSchedule(site *config.Site, v *events.Message) bool {
+	return state.isMaintainer(v) || site.IsGabbai(v.Info.Sender, v.Info.SenderAlt)
+}
+
+// Returns a user-facing message for invalid input, or an error for internal failures
+func (state *ProgramState) addTime(site *config.Site, args string, createdBy string) (string, error) {
+	entry, err := parseAddTimeCommand(args, site.Location)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	if err := addScheduleEntry(state.Ctx, state.DB, site.ID, entry, createdBy); err != nil {
+		return "", err
+	}
+
+	return "Added " + formatScheduleEntry(entry, site.Location), nil
+}
+
+func (state *ProgramState) removeTime(site *config.Site, args string) (string, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(args), "#"), 10, 64)
+	if err != nil {
+		return "Usage: `!removetime NUMBER`, with the number shown by `!listtimes`", nil
+	}
+
+	removed, err := removeScheduleEntry(state.Ctx, state.DB, site.ID, id)
+	if err != nil {
+		return "", err
+	}
+	if !removed {
+		return fmt.Sprintf("```There is no minyan #%d```", id), nil
+	}
+
+	return fmt.Sprintf("Removed #%d", id), nil
+}
+
+func (state *ProgramState) listTimes(site *config.Site) (string, error) {
+	entries, err := listScheduleEntries(state.Ctx, state.DB, site.ID, site.Location)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "*Schedule for %s:*", site.Name)
+
+	today := startOfDate(time.Now().In(site.Location))
+	shown := 0
+	for _, entry := range entries {
+		if entry.Weekdays == 0 && entry.Date.Before(today) {
+			continue
+		}
+		builder.WriteString("\n")
+		builder.WriteString(formatScheduleEntry(&entry, site.Location))
+		shown++
+	}
+
+	if shown == 0 {
+		builder.WriteString("\n(no times to show)")
+	}
+
+	return builder.String(), nil
+}
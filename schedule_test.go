@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAddTimeCommand(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args     string
+		name     string
+		minute   int
+		weekdays uint8
+	}{
+		{"mincha weekdays 1:45pm", "Mincha", 13*60 + 45, sundayFriday},
+		{"early shacharis daily 6:15 am", "Early Shacharis", 6*60 + 15, allWeekdays},
+		{"מנחה גדולה weekdays 1:45pm", "מנחה גדולה", 13*60 + 45, sundayFriday},
+		{"élan sun-thu 20:00", "Élan", 20 * 60, 0b0011111},
+	}
+	for _, test := range tests {
+		entry, err := parseAddTimeCommand(test.args, location)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if entry.Name != test.name || entry.Minute != test.minute || entry.Weekdays != test.weekdays {
+			t.Errorf("%q: got %q at %d on %07b, expected %q at %d on %07b",
+				test.args, entry.Name, entry.Minute, entry.Weekdays, test.name, test.minute, test.weekdays)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Each entry upgrades the database by one version. Released entries must never be edited, since
+// they have already run on existing databases; add a new entry instead.
+var databaseMigrations = []string{
+	// 1: Minyan times managed from chat, for sites with a local calendar
+	`CREATE TABLE minyan_schedule (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		site_id    TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		minute     INTEGER NOT NULL, -- Minutes after midnight
+		weekdays   INTEGER NOT NULL, -- Bitmask of time.Weekday, 0 for a one-off event
+		date       TEXT,             -- YYYY-MM-DD, only for one-off events
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL  -- Unix time
+	);
+	CREATE INDEX minyan_schedule_site ON minyan_schedule (site_id);`,
+
+	// 2: Cached Google calendars
+	`CREATE TABLE google_calendar_events (
+		calendar_id TEXT NOT NULL,
+		event_id    TEXT NOT NULL,
+		data        TEXT NOT NULL, -- The event as returned by the API, in JSON
+		PRIMARY KEY (calendar_id, event_id)
+	);
+	CREATE TABLE google_calendar_sync (
+		calendar_id TEXT PRIMARY KEY,
+		sync_token  TEXT NOT NULL,
+		synced_at   INTEGER NOT NULL -- Unix time
+	);`,
+
+	// 3: The last announced schedule of each site, to find changes in
+	`CREATE TABLE schedule_snapshots (
+		site_id  TEXT PRIMARY KEY,
+		data     TEXT NOT NULL, -- JSON
+		taken_at INTEGER NOT NULL -- Unix time
+	);`,
+
+	// 4: Messages waiting to be sent
+	`CREATE TABLE outbox (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		chat            TEXT NOT NULL,
+		message         BLOB NOT NULL,    -- waE2E.Message protobuf
+		message_id      TEXT NOT NULL,    -- The WhatsApp message ID, reused on retries
+		status          TEXT NOT NULL,    -- pending, sent or failed
+		attempts        INTEGER NOT NULL,
+		next_attempt_at INTEGER NOT NULL, -- Unix time in milliseconds
+		last_error      TEXT,
+		created_at      INTEGER NOT NULL, -- Unix time
+		sent_at         INTEGER           -- Unix time, from the server
+	);
+	CREATE INDEX outbox_pending ON outbox (status, next_attempt_at);`,
+
+	// 5: Message priorities (MessagePriority)
+	`ALTER TABLE outbox ADD COLUMN priority INTEGER NOT NULL DEFAULT 1;`,
+
+	// 6: Messages which must only be queued once, like a day's scheduled post to a group
+	`CREATE TABLE outbox_once (
+		key        TEXT PRIMARY KEY,
+		outbox_id  INTEGER NOT NULL,
+		created_at INTEGER NOT NULL -- Unix time
+	);`,
+
+	// 7: Scheduled posts which may still be edited if the schedule changes
+	`CREATE TABLE scheduled_posts (
+		key            TEXT PRIMARY KEY, -- The outbox_once key of the first part
+		site_id        TEXT NOT NULL,
+		header         TEXT NOT NULL,
+		dt_start       INTEGER NOT NULL, -- Unix time
+		dt_end         INTEGER NOT NULL, -- Unix time
+		include_passed INTEGER NOT NULL,
+		posted_at      INTEGER NOT NULL, -- Unix time, which minyanim had passed is as of then
+		parts          INTEGER NOT NULL,
+		content        TEXT NOT NULL     -- The sections as last sent, joined, without markers
+	);`,
+
+	// 8: The message with the week's schedule pinned in each group
+	`CREATE TABLE pinned_weeks (
+		site_id    TEXT NOT NULL,
+		chat       TEXT NOT NULL,
+		week       TEXT NOT NULL,    -- YYYY-MM-DD of the Sunday
+		outbox_id  INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		content    TEXT NOT NULL,    -- The sections as last sent, joined, without markers
+		PRIMARY KEY (site_id, chat)
+	);`,
+
+	// 9: Delivery and read receipts for sent messages
+	`CREATE TABLE message_receipts (
+		message_id   TEXT NOT NULL,
+		participant  TEXT NOT NULL, -- Who received it; in groups, each member
+		delivered_at INTEGER,       -- Unix time
+		read_at      INTEGER,       -- Unix time
+		PRIMARY KEY (message_id, participant)
+	);
+	CREATE INDEX outbox_message_id ON outbox (message_id);
+	ALTER TABLE outbox ADD COLUMN is_text INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE outbox ADD COLUMN undelivered_reported INTEGER NOT NULL DEFAULT 0;`,
+
+	// 10: The replies to each command, so they can be edited if the command is edited
+	`CREATE TABLE command_replies (
+		chat       TEXT NOT NULL,
+		message_id TEXT NOT NULL,    -- The message with the command
+		part       INTEGER NOT NULL, -- From 0, for replies split into several messages
+		outbox_id  INTEGER NOT NULL,
+		created_at INTEGER NOT NULL, -- Unix time
+		PRIMARY KEY (chat, message_id, part)
+	);`,
+
+	// 11: When each pinned week was posted, to limit how often it is reposted
+	`ALTER TABLE pinned_weeks ADD COLUMN posted_at INTEGER NOT NULL DEFAULT 0; -- Unix time`,
+
+	// 12: How many times each message was changed before it was sent, to catch changes made while
+	// it was being sent
+	`ALTER TABLE outbox ADD COLUMN version INTEGER NOT NULL DEFAULT 0;`,
+
+	// 13: Messages which act on another one, like pins, so they are dropped if it can't be sent
+	`ALTER TABLE outbox ADD COLUMN depends_on INTEGER NOT NULL DEFAULT 0; -- Outbox ID, 0 for none`,
+}
+
+// Opens the bot's own SQLite database (separate from whatsmeow's store), creating and upgrading it
+// as needed
+func OpenDatabase(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer at a time anyway
+	db.SetMaxOpenConns(1)
+
+	if err := migrateDatabase(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating database %s: %w", path, err)
+	}
+
+	return db, nil
+}
+
+func migrateDatabase(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(databaseMigrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, databaseMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %w", version+1, err)
+		}
+
+		// PRAGMA doesn't take parameters
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
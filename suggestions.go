@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// An error in what the user sent, whose message is meant to be shown to them. Other errors are
+// problems in the bot, which are reported to the maintainer.
+type UserError struct {
+	Message string
+}
+
+func (err *UserError) Error() string {
+	return err.Message
+}
+
+func userErrorf(format string, args ...any) error {
+	return &UserError{Message: fmt.Sprintf(format, args...)}
+}
+
+// The words `!times` understands, besides numbers
+var timesKeywords = []string{"upcoming", "week", "of", "to", "today", "tomorrow"}
+
+// Explains why the arguments of `!times` couldn't be parsed, suggesting the closest keyword, day of
+// the week or month name for the first word that isn't one
+func explainTimesArgs(text string) error {
+	vocabulary := slices.Concat(timesKeywords, slices.Collect(maps.Keys(dayOfWeekMap)), slices.Collect(maps.Keys(monthMap)))
+
+	for _, word := range strings.Fields(text) {
+		word = strings.Trim(word, ",.")
+		if !isWord(word) || slices.Contains(vocabulary, word) {
+			continue
+		}
+
+		if suggestion := closestWord(word, vocabulary); suggestion != "" {
+			return userErrorf("I couldn't understand `%s` — did you mean `%s`?", word, suggestion)
+		}
+		return userErrorf("I couldn't understand `%s` — it isn't a day of the week or a month. %s", word, timesExamples)
+	}
+
+	return userErrorf("I couldn't understand `%s`. %s", text, timesExamples)
+}
+
+const timesExamples = "Try a date like `tomorrow`, `sunday`, `3/14` or `march 14`, or send `!help` for everything `!times` understands"
+
+// Returns the word in vocabulary which word is most likely a misspelling of, or "" if none are
+// close enough. Ties go to the first word in alphabetical order, so that the result is stable.
+func closestWord(word string, vocabulary []string) string {
+	// Short words are too easily close to something
+	if len([]rune(word)) < 3 {
+		return ""
+	}
+	maxDistance := 1
+	if len([]rune(word)) >= 6 {
+		maxDistance = 2
+	}
+
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, candidate := range vocabulary {
+		distance := editDistance(word, candidate)
+		if distance < bestDistance || (distance == bestDistance && candidate < best) {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+	if bestDistance > maxDistance {
+		return ""
+	}
+	return best
+}
+
+// The Damerau-Levenshtein distance (optimal string alignment) between a and b: the number of
+// insertions, deletions, substitutions and swaps of adjacent letters that turn one into the other
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// Three rows of the table: two rows back, the previous one and the current one
+	before := make([]int, len(rb)+1)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				current[j] = min(current[j], before[j-2]+1)
+			}
+		}
+		before, previous, current = previous, current, before
+	}
+
+	return previous[len(rb)]
+}
+
+func isWord(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket rate limiter: it holds up to burst tokens, refilled at perSecond
+type TokenBucket struct {
+	mutex     sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	updatedAt time.Time
+}
+
+func NewTokenBucket(perSecond float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+		updatedAt: time.Now(),
+	}
+}
+
+// Takes a token if there is one. Otherwise returns false and how long until there will be one.
+func (bucket *TokenBucket) TryTake() (bool, time.Duration) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+	bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*bucket.perSecond)
+	bucket.updatedAt = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - bucket.tokens) / bucket.perSecond * float64(time.Second))
+}
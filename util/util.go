@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"math/rand/v2"
 	"regexp"
@@ -34,6 +35,19 @@ func RandBetween(bottom int, top int) int {
 	return bottom + rand.IntN(top-bottom)
 }
 
+// Sleeps for d, or until ctx is done. Returns false if ctx was done first.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 func AsMilliseconds(millis int) time.Duration {
 	return time.Duration(millis) * time.Millisecond
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"nbot-wa/config"
+	"nbot-wa/util"
+
+	"github.com/hebcal/hebcal-go/zmanim"
+)
+
+// The depression angle for tzeis, matching hebcal's default
+const tzeisAngle = 8.5
+
+var zmanimByName = map[string]func(z *zmanim.Zmanim) time.Time{
+	"alos":              (*zmanim.Zmanim).AlotHaShachar,
+	"alot":              (*zmanim.Zmanim).AlotHaShachar,
+	"alos hashachar":    (*zmanim.Zmanim).AlotHaShachar,
+	"alot hashachar":    (*zmanim.Zmanim).AlotHaShachar,
+	"dawn":              (*zmanim.Zmanim).AlotHaShachar,
+	"misheyakir":        (*zmanim.Zmanim).Misheyakir,
+	"netz":              (*zmanim.Zmanim).Sunrise,
+	"hanetz":            (*zmanim.Zmanim).Sunrise,
+	"sunrise":           (*zmanim.Zmanim).Sunrise,
+	"sof zman shma":     (*zmanim.Zmanim).SofZmanShma,
+	"sof zman shema":    (*zmanim.Zmanim).SofZmanShma,
+	"sof zman tefila":   (*zmanim.Zmanim).SofZmanTfilla,
+	"sof zman tefilla":  (*zmanim.Zmanim).SofZmanTfilla,
+	"chatzos":           (*zmanim.Zmanim).Chatzot,
+	"chatzot":           (*zmanim.Zmanim).Chatzot,
+	"midday":            (*zmanim.Zmanim).Chatzot,
+	"mincha gedola":     (*zmanim.Zmanim).MinchaGedola,
+	"mincha ketana":     (*zmanim.Zmanim).MinchaKetana,
+	"plag":              (*zmanim.Zmanim).PlagHaMincha,
+	"plag hamincha":     (*zmanim.Zmanim).PlagHaMincha,
+	"shkiah":            (*zmanim.Zmanim).Sunset,
+	"shkia":             (*zmanim.Zmanim).Sunset,
+	"shekiah":           (*zmanim.Zmanim).Sunset,
+	"sunset":            (*zmanim.Zmanim).Sunset,
+	"tzeis":             func(z *zmanim.Zmanim) time.Time { return z.Tzeit(tzeisAngle) },
+	"tzeit":             func(z *zmanim.Zmanim) time.Time { return z.Tzeit(tzeisAngle) },
+	"tzes":              func(z *zmanim.Zmanim) time.Time { return z.Tzeit(tzeisAngle) },
+	"nightfall":         func(z *zmanim.Zmanim) time.Time { return z.Tzeit(tzeisAngle) },
+	"chatzos halayla":   (*zmanim.Zmanim).ChatzotNight,
+	"chatzot halayla":   (*zmanim.Zmanim).ChatzotNight,
+	"chatzos ha'layla":  (*zmanim.Zmanim).ChatzotNight,
+	"midnight":          (*zmanim.Zmanim).ChatzotNight,
+	"bein hashmashos":   (*zmanim.Zmanim).BeinHashmashos,
+	"bein hashmashot":   (*zmanim.Zmanim).BeinHashmashos,
+	"sof zman shma mga": (*zmanim.Zmanim).SofZmanShmaMGA,
+}
+
+type roundingMode int
+
+const (
+	roundNearest roundingMode = iota
+	roundDown
+	roundUp
+)
+
+var (
+	rZmanimExpression = regexp.MustCompile(`^([a-z' ]+?)\s*(?:([+-])\s*(.+?))?\s*(?:,\s*(.+))?$`)
+	rZmanimRounding   = regexp.MustCompile(`^round(?:ed)?(?:\s+(up|down|nearest))?\s+to(?:\s+the\s+nearest)?\s+(\d+)\s*(?:m|min|mins|minutes?)$`)
+	rZmanimOffsetPart = regexp.MustCompile(`(\d+)\s*(hours?|hrs?|h|minutes?|mins?|m)?`)
+)
+
+// A parsed config.ZmanimRule
+type zmanimRule struct {
+	name string
+
+	zman   func(z *zmanim.Zmanim) time.Time
+	offset time.Duration
+
+	rounding roundingMode
+	roundTo  time.Duration
+
+	// Bitmask of time.Weekday
+	weekdays uint8
+	// YYYY-MM-DD, or empty for no limit
+	from  string
+	until string
+}
+
+// Parses a zmanim expression like "shkiah - 15m, rounded down to 5 min" or "tzeis + 0"
+func parseZmanimExpression(expression string) (zman func(z *zmanim.Zmanim) time.Time, offset time.Duration, rounding roundingMode, roundTo time.Duration, err error) {
+	expression = util.NormalizeString(expression)
+
+	match := rZmanimExpression.FindStringSubmatch(expression)
+	if match == nil {
+		return nil, 0, 0, 0, fmt.Errorf("could not understand %q, expected something like \"shkiah - 15m, rounded down to 5 min\"", expression)
+	}
+
+	zman, ok := zmanimByName[strings.TrimSpace(match[1])]
+	if !ok {
+		return nil, 0, 0, 0, fmt.Errorf("unknown zman %q", strings.TrimSpace(match[1]))
+	}
+
+	if match[3] != "" {
+		offset, err = parseZmanimOffset(match[3])
+		if err != nil {
+			return nil, 0, 0, 0, err
+		}
+		if match[2] == "-" {
+			offset = -offset
+		}
+	}
+
+	// Times are shown to the minute
+	rounding, roundTo = roundNearest, time.Minute
+	if match[4] != "" {
+		roundingMatch := rZmanimRounding.FindStringSubmatch(match[4])
+		if roundingMatch == nil {
+			return nil, 0, 0, 0, fmt.Errorf("could not understand the rounding %q, expected something like \"rounded down to 5 min\"", match[4])
+		}
+
+		switch roundingMatch[1] {
+		case "up":
+			rounding = roundUp
+		case "down":
+			rounding = roundDown
+		}
+
+		minutes, _ := strconv.Atoi(roundingMatch[2])
+		if minutes == 0 || 60%minutes != 0 {
+			return nil, 0, 0, 0, fmt.Errorf("cannot round to %d minutes, it must divide an hour evenly", minutes)
+		}
+		roundTo = time.Duration(minutes) * time.Minute
+	}
+
+	return zman, offset, rounding, roundTo, nil
+}
+
+// Parses an offset like "15m", "15 minutes", "1h 30m" or "0" (which is in minutes)
+func parseZmanimOffset(s string) (time.Duration, error) {
+	var offset time.Duration
+	rest := s
+	matches := rZmanimOffsetPart.FindAllStringSubmatch(s, -1)
+	for _, match := range matches {
+		n, _ := strconv.Atoi(match[1])
+		if strings.HasPrefix(match[2], "h") {
+			offset += time.Duration(n) * time.Hour
+		} else {
+			offset += time.Duration(n) * time.Minute
+		}
+		rest = strings.Replace(rest, match[0], "", 1)
+	}
+
+	if len(matches) == 0 || strings.TrimSpace(rest) != "" {
+		return 0, fmt.Errorf("could not understand the offset %q, expected something like \"15m\" or \"1h 30m\"", s)
+	}
+
+	return offset, nil
+}
+
+// Rounds t to a multiple of step, counted from midnight in t's location
+func roundZmanimTime(t time.Time, rounding roundingMode, step time.Duration) time.Time {
+	midnight := startOfDate(t)
+	sinceMidnight := t.Sub(midnight)
+
+	rounded := sinceMidnight.Truncate(step)
+	switch rounding {
+	case roundUp:
+		if rounded != sinceMidnight {
+			rounded += step
+		}
+	case roundNearest:
+		rounded = sinceMidnight.Round(step)
+	}
+
+	return midnight.Add(rounded)
+}
+
+func parseZmanimRule(rule config.ZmanimRule, location *time.Location) (*zmanimRule, error) {
+	zman, offset, rounding, roundTo, err := parseZmanimExpression(rule.Time)
+	if err != nil {
+		return nil, err
+	}
+
+	weekdays := allWeekdays
+	if days := util.NormalizeString(rule.Days); days != "" {
+		var ok bool
+		weekdays, _, ok = parseScheduleDays(days, location)
+		if !ok || weekdays == 0 {
+			return nil, fmt.Errorf("could not understand the days %q, expected something like \"daily\", \"weekdays\", \"sun-thu\" or \"mon,wed\"", rule.Days)
+		}
+	}
+
+	return &zmanimRule{
+		name:     rule.Name,
+		zman:     zman,
+		offset:   offset,
+		rounding: rounding,
+		roundTo:  roundTo,
+		weekdays: weekdays,
+		from:     rule.From,
+		until:    rule.Until,
+	}, nil
+}
+
+// Returns the time of the minyan on date, or false if there isn't one that day
+func (rule *zmanimRule) timeOn(date time.Time, zmanimLocation *zmanim.Location) (time.Time, bool) {
+	if rule.weekdays&(1<<date.Weekday()) == 0 {
+		return time.Time{}, false
+	}
+
+	day := date.Format(time.DateOnly)
+	if (rule.from != "" && day < rule.from) || (rule.until != "" && day > rule.until) {
+		return time.Time{}, false
+	}
+
+	z := zmanim.New(zmanimLocation, date)
+	t := rule.zman(&z)
+	if t.IsZero() {
+		// The sun doesn't reach the zman's angle on this day
+		return time.Time{}, false
+	}
+
+	t = t.In(date.Location()).Add(rule.offset)
+	return roundZmanimTime(t, rule.rounding, rule.roundTo), true
+}
+
+// An EventSource that generates minyan times from a site's zmanim rules
+type ZmanimRuleEventSource struct {
+	rules          []*zmanimRule
+	location       *time.Location
+	zmanimLocation *zmanim.Location
+}
+
+// Parses the site's zmanim rules, returning all of the errors in them
+func NewZmanimRuleEventSource(site *config.Site) (*ZmanimRuleEventSource, error) {
+	source := &ZmanimRuleEventSource{
+		location:       site.Location,
+		zmanimLocation: site.ZmanimLocation,
+	}
+
+	var errs []error
+	for i, rule := range site.ZmanimRules {
+		parsed, err := parseZmanimRule(rule, site.Location)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sites[%s].zmanim_rules[%d] (%s): %w", site.ID, i, rule.Name, err))
+			continue
+		}
+		source.rules = append(source.rules, parsed)
+	}
+
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return source, nil
+}
+
+func (source *ZmanimRuleEventSource) Events(ctx context.Context, dtStart time.Time, dtEnd time.Time) ([]ParsedEvent, error) {
+	parsedEvents := []ParsedEvent{}
+	for day := startOfDate(dtStart.In(source.location)); !day.After(dtEnd); day = day.AddDate(0, 0, 1) {
+		for _, rule := range source.rules {
+			t, ok := rule.timeOn(day, source.zmanimLocation)
+			if !ok || t.Before(dtStart) || t.After(dtEnd) {
+				continue
+			}
+
+			parsedEvents = append(parsedEvents, ParsedEvent{
+				Name:     rule.name,
+				DateTime: t,
+			})
+		}
+	}
+
+	sortParsedEvents(parsedEvents)
+	return parsedEvents, nil
+}